@@ -1,109 +1,5149 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math/big"
+	mrand "math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	neturl "net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-func startServer(addr chan string) {
+type User struct {
+	ID    int    `json:"id"`
+	User  string `json:"user"`
+	Email string `json:"email,omitempty"`
+}
+
+type clientConfig struct {
+	// StrictJSON запрещает незнакомые поля в JSON-ответах сервера
+	StrictJSON bool
+	// BatchConcurrency - сколько запросов runBatch выполняет одновременно
+	BatchConcurrency int
+	// ForceHTTP1 запрещает TLS-клиенту договариваться о HTTP/2
+	ForceHTTP1 bool
+	// SigningSecret - ключ HMAC для подписи запросов (X-Signature)
+	SigningSecret []byte
+	// DialRetries - сколько раз повторить неудачное TCP-подключение,
+	// пауза между попытками растёт от DialBackoff
+	DialRetries int
+	DialBackoff time.Duration
+}
+
+var clientCfg = clientConfig{
+	BatchConcurrency: 4,
+	SigningSecret:    []byte("demo-signing-secret"),
+	DialRetries:      5,
+	DialBackoff:      50 * time.Millisecond,
+}
+
+type serverConfig struct {
+	// Addr - адрес для net.Listen, ":0" выбирает свободный порт
+	Addr string
+	// MaxRequestTimeout ограничивает таймаут, который клиент просит через X-Request-Timeout
+	MaxRequestTimeout time.Duration
+	// MaxConns - сколько соединений сервер держит одновременно, 0 - без ограничений
+	MaxConns int
+	// IdleTimeout закрывает простаивающие keep-alive соединения, иначе они
+	// навсегда занимают слоты MaxConns
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout обрывает клиентов, которые слишком долго шлют заголовки (slowloris)
+	ReadHeaderTimeout time.Duration
+	Chaos             chaosConfig
+	// AuthSchemes - какие схемы принимает withAuth: "basic", "bearer"
+	AuthSchemes []string
+	JWTSecret   []byte
+	// MaxInFlight запросов обрабатываются одновременно, ещё QueueSize ждут слота
+	// не дольше QueueWait; MaxInFlight = 0 выключает ограничение
+	MaxInFlight int
+	QueueSize   int
+	QueueWait   time.Duration
+	// SigningSecret проверяет X-Signature; запросы старше SignatureSkew отклоняются
+	SigningSecret []byte
+	SignatureSkew time.Duration
+	// EnvAllowlist - какие переменные окружения можно отдавать через /env
+	EnvAllowlist []string
+	// соединение закрывается после MaxRequestsPerConn запросов или через MaxConnAge,
+	// смотря что наступит раньше; 0 выключает соответствующий лимит
+	MaxRequestsPerConn int
+	MaxConnAge         time.Duration
+	// MaxUploadBytes - больше этого /upload не принимает, 0 - без ограничений
+	MaxUploadBytes int64
+	// ShutdownTimeout - сколько ждать активные запросы перед принудительным закрытием
+	ShutdownTimeout time.Duration
+	// KVPath - файл, в котором /kv переживает перезапуск; пустой - только
+	// в памяти. Запись на диск откладывается на KVFlushDelay, чтобы серия PUT
+	// давала одну запись
+	KVPath       string
+	KVFlushDelay time.Duration
+	// AggregateTimeout ограничивает каждый внутренний запрос /aggregate
+	AggregateTimeout time.Duration
+}
+
+// chaosConfig задаёт искусственные задержки и ошибки для проверки устойчивости клиентов
+type chaosConfig struct {
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	// ErrorRate - доля запросов от 0 до 1, на которые отвечаем 500
+	ErrorRate float64
+}
+
+func (c chaosConfig) enabled() bool {
+	return c.MaxLatency > 0 || c.ErrorRate > 0
+}
+
+func loadChaosConfig() (chaosConfig, error) {
+	cfg := chaosConfig{}
+	var err error
+	if raw := os.Getenv("CHAOS_MIN_LATENCY"); raw != "" {
+		if cfg.MinLatency, err = time.ParseDuration(raw); err != nil {
+			return cfg, fmt.Errorf("CHAOS_MIN_LATENCY: %w", err)
+		}
+	}
+	if raw := os.Getenv("CHAOS_MAX_LATENCY"); raw != "" {
+		if cfg.MaxLatency, err = time.ParseDuration(raw); err != nil {
+			return cfg, fmt.Errorf("CHAOS_MAX_LATENCY: %w", err)
+		}
+	}
+	if cfg.MaxLatency < cfg.MinLatency {
+		cfg.MaxLatency = cfg.MinLatency
+	}
+	if raw := os.Getenv("CHAOS_ERROR_RATE"); raw != "" {
+		if cfg.ErrorRate, err = strconv.ParseFloat(raw, 64); err != nil {
+			return cfg, fmt.Errorf("CHAOS_ERROR_RATE: %w", err)
+		}
+		if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+			return cfg, fmt.Errorf("CHAOS_ERROR_RATE: %v is not between 0 and 1", cfg.ErrorRate)
+		}
+	}
+	return cfg, nil
+}
+
+var serverCfg = serverConfig{
+	Addr:               ":0",
+	MaxRequestTimeout:  5 * time.Second,
+	MaxConns:           100,
+	IdleTimeout:        30 * time.Second,
+	ReadHeaderTimeout:  2 * time.Second,
+	AuthSchemes:        []string{"basic", "bearer"},
+	JWTSecret:          []byte("demo-jwt-secret"),
+	MaxInFlight:        16,
+	QueueSize:          16,
+	QueueWait:          250 * time.Millisecond,
+	SigningSecret:      []byte("demo-signing-secret"),
+	SignatureSkew:      5 * time.Minute,
+	EnvAllowlist:       []string{"LOG_LEVEL", "LOG_FORMAT", "RATE_LIMIT", "AUTH_SCHEMES", "GOMAXPROCS"},
+	MaxRequestsPerConn: 0,
+	MaxConnAge:         time.Minute,
+	MaxUploadBytes:     1 << 20,
+	ShutdownTimeout:    5 * time.Second,
+	KVFlushDelay:       100 * time.Millisecond,
+	AggregateTimeout:   300 * time.Millisecond,
+}
+
+// демо-учётки, настоящий сервис брал бы их из хранилища
+var (
+	demoUsers  = map[string]string{"rvasily": "secret"}
+	demoTokens = map[string]string{"demo-token": "service-account"}
+)
+
+// reloadableConfig - то, что можно поменять на работающем сервере по SIGHUP
+type reloadableConfig struct {
+	// RateLimit - запросов в секунду на весь сервер, 0 - без ограничений
+	RateLimit int
+	LogLevel  slog.Level
+	// Drain просит клиентов переподключиться: ответы уходят с Connection: close
+	Drain bool
+}
+
+var liveCfg atomic.Pointer[reloadableConfig]
+
+func loadReloadableConfig() (*reloadableConfig, error) {
+	cfg := &reloadableConfig{}
+	if raw := os.Getenv("RATE_LIMIT"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT: %w", err)
+		}
+		cfg.RateLimit = limit
+	}
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if err := cfg.LogLevel.UnmarshalText([]byte(raw)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+	}
+	cfg.Drain = os.Getenv("DRAIN") == "1"
+	return cfg, nil
+}
+
+func applyConfig(cfg *reloadableConfig) {
+	liveCfg.Store(cfg)
+	logLevel.Set(cfg.LogLevel)
+}
+
+func watchConfigReload(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		cfg, err := loadReloadableConfig()
+		if err != nil {
+			logger.Error("config reload failed", "err", err)
+			continue
+		}
+		applyConfig(cfg)
+		logger.Info("config reloaded", "rate_limit", cfg.RateLimit, "log_level", cfg.LogLevel, "drain", cfg.Drain)
+	}
+}
+
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = slog.Default()
+)
+
+// newLogger выбирает формат вывода: LOG_FORMAT=json или текст по умолчанию
+func newLogger(format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, opts))
+}
+
+func decodeJSON(r io.Reader, dst interface{}, strict bool) error {
+	dec := json.NewDecoder(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(dst)
+}
+
+type connKey struct{}
+
+type connStats struct {
+	opened   time.Time
+	requests int
+	state    http.ConnState
+}
+
+// connLimiter считает запросы на каждом соединении и просит клиента
+// переподключиться, чтобы нагрузка перераспределялась между бэкендами
+type connLimiter struct {
+	maxRequests int
+	maxAge      time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]*connStats
+}
+
+func newConnLimiter(maxRequests int, maxAge time.Duration) *connLimiter {
+	return &connLimiter{
+		maxRequests: maxRequests,
+		maxAge:      maxAge,
+		conns:       map[net.Conn]*connStats{},
+	}
+}
+
+// connContext кладёт соединение в контекст, чтобы wrap нашёл его счётчик
+func (l *connLimiter) connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+func (l *connLimiter) connState(c net.Conn, state http.ConnState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		l.conns[c] = &connStats{opened: time.Now(), state: state}
+	case http.StateHijacked, http.StateClosed:
+		delete(l.conns, c)
+	default:
+		if stats, ok := l.conns[c]; ok {
+			stats.state = state
+		}
+	}
+}
+
+// active - сколько соединений сейчас обрабатывают запрос (простаивающие не в счёт)
+func (l *connLimiter) active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, stats := range l.conns {
+		if stats.state == http.StateActive {
+			n++
+		}
+	}
+	return n
+}
+
+// served отмечает запрос и сообщает, пора ли закрывать соединение
+func (l *connLimiter) served(c net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats, ok := l.conns[c]
+	if !ok {
+		return false
+	}
+	stats.requests++
+	if l.maxRequests > 0 && stats.requests >= l.maxRequests {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(stats.opened) >= l.maxAge
+}
+
+func (l *connLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(connKey{}).(net.Conn); ok && l.served(c) {
+			// сервер сам закроет соединение после этого ответа
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drainState отмечает момент, когда сервер начал graceful shutdown
+type drainState struct {
+	once    sync.Once
+	started chan struct{}
+	at      time.Time
+}
+
+func newDrainState() *drainState {
+	return &drainState{started: make(chan struct{})}
+}
+
+func (d *drainState) begin() {
+	d.once.Do(func() {
+		d.at = time.Now()
+		close(d.started)
+	})
+}
+
+type drainEvent struct {
+	Active    int   `json:"active"`
+	ElapsedMS int64 `json:"elapsed_ms"`
+	Drained   bool  `json:"drained,omitempty"`
+}
+
+func writeEvent(w io.Writer, event string, data interface{}) {
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+// shutdownStatusHandler ждёт начала остановки и стримит (SSE), сколько активных
+// соединений осталось; своё соединение не считается. Последнее событие done
+// приходит, когда активных не осталось или вышел timeout
+func shutdownStatusHandler(conns *connLimiter, drain *drainState, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeEvent(w, "waiting", drainEvent{Active: conns.active() - 1})
+		if err := rc.Flush(); err != nil {
+			logger.Error("streaming unsupported", "err", err)
+			return
+		}
+
+		select {
+		case <-drain.started:
+		case <-r.Context().Done():
+			return
+		}
+
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		last := -1
+		for {
+			ev := drainEvent{Active: conns.active() - 1, ElapsedMS: time.Since(drain.at).Milliseconds()}
+			switch {
+			case ev.Active <= 0:
+				ev.Active, ev.Drained = 0, true
+				writeEvent(w, "done", ev)
+				rc.Flush()
+				return
+			case time.Since(drain.at) >= timeout:
+				writeEvent(w, "done", ev)
+				rc.Flush()
+				return
+			case ev.Active != last:
+				writeEvent(w, "drain", ev)
+				rc.Flush()
+				last = ev.Active
+			}
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	// (N+1)-е соединение ждёт, пока освободится одно из N
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// NetConn отдаёт обёрнутое соединение, как tls.Conn.NetConn
+func (c *limitConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+var (
+	errUserNotFound       = errors.New("user not found")
+	errPreconditionFailed = errors.New("precondition failed")
+)
+
+type storedUser struct {
+	User
+	version int
+}
+
+type userStore struct {
+	mu    sync.Mutex
+	users map[int]*storedUser
+}
+
+func newUserStore() *userStore {
+	return &userStore{
+		users: map[int]*storedUser{
+			42: {User: User{ID: 42, User: "rvasily", Email: "rvasily@example.com"}, version: 1},
+		},
+	}
+}
+
+func userETag(version int) string {
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+func (s *userStore) get(id int) (User, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[id]
+	if !ok {
+		return User{}, "", errUserNotFound
+	}
+	return stored.User, userETag(stored.version), nil
+}
+
+// update применяет change, только если ETag из If-Match всё ещё актуален
+func (s *userStore) update(id int, ifMatch string, change func(*User) error) (User, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[id]
+	if !ok {
+		return User{}, "", errUserNotFound
+	}
+	if ifMatch != "" && ifMatch != "*" && ifMatch != userETag(stored.version) {
+		return User{}, "", errPreconditionFailed
+	}
+
+	updated := stored.User
+	if err := change(&updated); err != nil {
+		return User{}, "", err
+	}
+	updated.ID = id
+
+	stored.User = updated
+	stored.version++
+	return stored.User, userETag(stored.version), nil
+}
+
+func writeUser(w http.ResponseWriter, user User, etag string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (s *userStore) handleGet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "bad user id", http.StatusBadRequest)
+		return
+	}
+
+	user, etag, err := s.get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeUser(w, user, etag)
+}
+
+func (s *userStore) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "bad user id", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	user, etag, err := s.update(id, r.Header.Get("If-Match"), func(u *User) error {
+		// PUT заменяет пользователя целиком, PATCH меняет только переданные поля
+		if r.Method == http.MethodPut {
+			*u = User{}
+		}
+		return json.Unmarshal(body, u)
+	})
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errPreconditionFailed):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeUser(w, user, etag)
+	}
+}
+
+const (
+	clientPid = 1
+	serverPid = 2
+)
+
+type span struct {
+	name  string
+	pid   int
+	lane  int
+	start time.Time
+	dur   time.Duration
+}
+
+// spanCollector собирает интервалы запросов клиента и сервера; lane -
+// номер "дорожки", чтобы одновременные запросы не рисовались друг на друге
+type spanCollector struct {
+	mu     sync.Mutex
+	origin time.Time
+	busy   map[int][]bool
+	spans  []span
+}
+
+// tracer == nil означает, что трассировка выключена
+var tracer *spanCollector
+
+func newSpanCollector() *spanCollector {
+	return &spanCollector{origin: time.Now(), busy: map[int][]bool{}}
+}
+
+func (c *spanCollector) start(name string, pid int) func() {
+	if c == nil {
+		return func() {}
+	}
+
+	c.mu.Lock()
+	lanes := c.busy[pid]
+	lane := slices.Index(lanes, false)
+	if lane < 0 {
+		lane = len(lanes)
+		lanes = append(lanes, false)
+	}
+	lanes[lane] = true
+	c.busy[pid] = lanes
+	c.mu.Unlock()
+
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			dur := time.Since(start)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.busy[pid][lane] = false
+			c.spans = append(c.spans, span{name: name, pid: pid, lane: lane, start: start, dur: dur})
+		})
+	}
+}
+
+type chromeEvent struct {
+	Name string            `json:"name"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`
+	Dur  int64             `json:"dur"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// writeChromeTrace сохраняет спаны в формате chrome://tracing (время в микросекундах)
+func (c *spanCollector) writeChromeTrace(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	events := []chromeEvent{
+		{Name: "process_name", Ph: "M", Pid: clientPid, Args: map[string]string{"name": "client"}},
+		{Name: "process_name", Ph: "M", Pid: serverPid, Args: map[string]string{"name": "server"}},
+	}
+	for _, sp := range c.spans {
+		events = append(events, chromeEvent{
+			Name: sp.name,
+			Ph:   "X",
+			Ts:   sp.start.Sub(c.origin).Microseconds(),
+			Dur:  sp.dur.Microseconds(),
+			Pid:  sp.pid,
+			Tid:  sp.lane,
+		})
+	}
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end := tracer.start(r.Method+" "+r.URL.Path, serverPid)
+		defer end()
+		next.ServeHTTP(w, r)
+	})
+}
+
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	end := tracer.start(req.Method+" "+req.URL.Path, clientPid)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	// клиентский спан заканчивается, когда тело дочитано и закрыто
+	resp.Body = &tracedBody{ReadCloser: resp.Body, end: end}
+	return resp, nil
+}
+
+type tracedBody struct {
+	io.ReadCloser
+	end func()
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.end()
+	return err
+}
+
+// traced оборачивает транспорт клиента, если трассировка включена
+func traced(rt http.RoundTripper) http.RoundTripper {
+	if tracer == nil {
+		return rt
+	}
+	return &tracingTransport{base: rt}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// у каждого значения свой неэкспортируемый тип ключа, поэтому
+// чужой пакет не перетрёт его даже ключом с тем же именем
+type (
+	startKey     struct{}
+	requestIDKey struct{}
+	principalKey struct{}
+)
+
+func withStart(ctx context.Context, start time.Time) context.Context {
+	return context.WithValue(ctx, startKey{}, start)
+}
+
+func startFrom(ctx context.Context) (time.Time, bool) {
+	start, ok := ctx.Value(startKey{}).(time.Time)
+	return start, ok
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func principalFrom(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+	return principal, ok
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestContext - самый внешний middleware: запоминает время начала
+// и request ID (из X-Request-ID клиента или новый) для всех остальных
+func withRequestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := withRequestID(withStart(r.Context(), time.Now()), id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withLogging должен оборачивать сам mux: r.Pattern заполняется внутри ServeHTTP
+func withLogging(stats *latencyStats, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, ok := startFrom(r.Context())
+		if !ok {
+			start = time.Now()
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+		id, _ := requestIDFrom(r.Context())
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		stats.record(route, duration)
+
+		logger.Debug("request served",
+			"request_id", id,
+			"method", r.Method,
+			"url", r.URL.String(),
+			"route", route,
+			"status", rec.status,
+			"duration", duration)
+	})
+}
+
+// latencyBounds - верхние границы корзин гистограммы: от 100мкс до ~30с,
+// по четыре корзины на каждое удвоение, то есть погрешность не больше 19%
+var latencyBounds = func() []time.Duration {
+	bounds := []time.Duration{}
+	for b := float64(100 * time.Microsecond); b < float64(30*time.Second); b *= 1.189207 {
+		bounds = append(bounds, time.Duration(b))
+	}
+	return bounds
+}()
+
+type histogram struct {
+	// последняя корзина - всё, что дольше latencyBounds
+	buckets []int64
+	count   int64
+}
+
+func (h *histogram) record(d time.Duration) {
+	i, _ := slices.BinarySearch(latencyBounds, d)
+	h.buckets[i]++
+	h.count++
+}
+
+// percentile возвращает верхнюю границу корзины, в которую попал q-й квантиль
+func (h *histogram) percentile(q float64) time.Duration {
+	rank := int64(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			if i == len(latencyBounds) {
+				break
+			}
+			return latencyBounds[i]
+		}
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+type routeStats struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+type latencyStats struct {
+	mu     sync.Mutex
+	routes map[string]*histogram
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{routes: map[string]*histogram{}}
+}
+
+func (s *latencyStats) record(route string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.routes[route]
+	if !ok {
+		h = &histogram{buckets: make([]int64, len(latencyBounds)+1)}
+		s.routes[route] = h
+	}
+	h.record(d)
+}
+
+func (s *latencyStats) snapshot() map[string]routeStats {
+	ms := func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := map[string]routeStats{}
+	for route, h := range s.routes {
+		res[route] = routeStats{
+			Count: h.count,
+			P50:   ms(h.percentile(0.50)),
+			P90:   ms(h.percentile(0.90)),
+			P99:   ms(h.percentile(0.99)),
+		}
+	}
+	return res
+}
+
+type rateLimiter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+func (l *rateLimiter) allow(limit int, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart = now
+		l.count = 0
+	}
+	if l.count >= limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// withLiveConfig читает конфиг на каждый запрос, поэтому SIGHUP
+// начинает действовать без перезапуска сервера
+func withLiveConfig(limiter *rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := liveCfg.Load()
+		if cfg == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if cfg.Drain {
+			w.Header().Set("Connection", "close")
+		}
+		if !limiter.allow(cfg.RateLimit, time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenance переключается на лету через PUT /admin/maintenance или MAINTENANCE=1
+var maintenance atomic.Bool
+
+const maintenancePath = "/admin/maintenance"
+
+// maintenanceExempt - маршруты, которые отвечают и во время обслуживания:
+// проверки балансировщика и сам переключатель
+var maintenanceExempt = map[string]bool{
+	"/healthz":      true,
+	"/version":      true,
+	maintenancePath: true,
+}
+
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !maintenance.Load() || maintenanceExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "maintenance"})
+	})
+}
+
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		state := maintenanceState{}
+		err := decodeJSON(http.MaxBytesReader(w, r.Body, 1<<10), &state, true)
+		r.Body.Close()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		maintenance.Store(state.Enabled)
+		principal, _ := principalFrom(r.Context())
+		logger.Info("maintenance mode changed", "enabled", state.Enabled, "by", principal)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceState{Enabled: maintenance.Load()})
+}
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+func newCSRFToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := crand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// withCSRF - защита double-submit: безопасные запросы получают токен в cookie,
+// изменяющие запросы обязаны повторить его в заголовке X-CSRF-Token
+func withCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookieName)
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			if err != nil {
+				token, err := newCSRFToken()
+				if err != nil {
+					http.Error(w, "internal error", 500)
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookieName,
+					Value:    token,
+					Path:     "/",
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get(csrfHeaderName)
+		if err != nil || header == "" ||
+			subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			http.Error(w, "csrf token mismatch", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func withChaos(cfg chaosConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay := cfg.MinLatency
+		if cfg.MaxLatency > cfg.MinLatency {
+			delay += mrand.N(cfg.MaxLatency - cfg.MinLatency)
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if cfg.ErrorRate > 0 && mrand.Float64() < cfg.ErrorRate {
+			w.Header().Set("X-Chaos", "error")
+			http.Error(w, "chaos: injected failure", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var (
+	errNoCredentials  = errors.New("no credentials")
+	errBadCredentials = errors.New("bad credentials")
+)
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal string, err error)
+}
+
+type basicAuthenticator struct {
+	users map[string]string
+}
+
+func (a basicAuthenticator) Authenticate(r *http.Request) (string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", errNoCredentials
+	}
+	want, found := a.users[user]
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 || !found {
+		return "", errBadCredentials
+	}
+	return user, nil
+}
+
+// bearerAuthenticator принимает статические токены и, если задан secret, JWT HS256
+type bearerAuthenticator struct {
+	tokens map[string]string
+	secret []byte
+}
+
+func (a bearerAuthenticator) Authenticate(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errNoCredentials
+	}
+
+	if a.secret != nil && strings.Count(token, ".") == 2 {
+		return verifyJWT(token, a.secret, time.Now())
+	}
+	for known, principal := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return principal, nil
+		}
+	}
+	return "", errBadCredentials
+}
+
+// chainAuthenticator пробует схемы по очереди, пока одна не найдёт свои креды
+type chainAuthenticator []Authenticator
+
+func (c chainAuthenticator) Authenticate(r *http.Request) (string, error) {
+	for _, a := range c {
+		principal, err := a.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return "", errNoCredentials
+}
+
+func newAuthenticator(schemes []string) Authenticator {
+	chain := chainAuthenticator{}
+	for _, scheme := range schemes {
+		switch scheme {
+		case "basic":
+			chain = append(chain, basicAuthenticator{users: demoUsers})
+		case "bearer":
+			chain = append(chain, bearerAuthenticator{tokens: demoTokens, secret: serverCfg.JWTSecret})
+		default:
+			logger.Warn("unknown auth scheme skipped", "scheme", scheme)
+		}
+	}
+	return chain
+}
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Exp int64  `json:"exp,omitempty"`
+}
+
+const jwtHeader = `{"alg":"HS256","typ":"JWT"}`
+
+func signJWT(claims jwtClaims, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(jwtHeader)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyJWT(token string, secret []byte, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errBadCredentials
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errBadCredentials
+	}
+	alg := struct {
+		Alg string `json:"alg"`
+	}{}
+	if json.Unmarshal(header, &alg) != nil || alg.Alg != "HS256" {
+		return "", errBadCredentials
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errBadCredentials
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errBadCredentials
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errBadCredentials
+	}
+	claims := jwtClaims{}
+	if json.Unmarshal(payload, &claims) != nil || claims.Sub == "" {
+		return "", errBadCredentials
+	}
+	if claims.Exp != 0 && now.Unix() >= claims.Exp {
+		return "", fmt.Errorf("%w: token expired", errBadCredentials)
+	}
+	return claims.Sub, nil
+}
+
+func withAuth(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="demo", Bearer realm="demo"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	})
+}
+
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFrom(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"principal": principal})
+}
+
+type admissionMetrics struct {
+	Admitted int64 `json:"admitted"`
+	Queued   int64 `json:"queued"`
+	Rejected int64 `json:"rejected"`
+	Waiting  int64 `json:"waiting"`
+}
+
+// admissionControl - семафор с ограниченной очередью ожидания: в отличие от
+// простого семафора запрос может немного подождать, прежде чем получить 503
+type admissionControl struct {
+	slots     chan struct{}
+	queueSize int64
+	maxWait   time.Duration
+
+	waiting  atomic.Int64
+	admitted atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Int64
+}
+
+func newAdmissionControl(maxInFlight, queueSize int, maxWait time.Duration) *admissionControl {
+	return &admissionControl{
+		slots:     make(chan struct{}, maxInFlight),
+		queueSize: int64(queueSize),
+		maxWait:   maxWait,
+	}
+}
+
+func (a *admissionControl) metrics() admissionMetrics {
+	return admissionMetrics{
+		Admitted: a.admitted.Load(),
+		Queued:   a.queued.Load(),
+		Rejected: a.rejected.Load(),
+		Waiting:  a.waiting.Load(),
+	}
+}
+
+func (a *admissionControl) reject(w http.ResponseWriter) {
+	a.rejected.Add(1)
+	retryAfter := max(1, int(a.maxWait.Round(time.Second)/time.Second))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+}
+
+func (a *admissionControl) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case a.slots <- struct{}{}:
+			a.admitted.Add(1)
+		default:
+			if a.waiting.Add(1) > a.queueSize {
+				a.waiting.Add(-1)
+				a.reject(w)
+				return
+			}
+
+			timer := time.NewTimer(a.maxWait)
+			select {
+			case a.slots <- struct{}{}:
+				a.waiting.Add(-1)
+				timer.Stop()
+				a.queued.Add(1)
+			case <-timer.C:
+				a.waiting.Add(-1)
+				a.reject(w)
+				return
+			case <-r.Context().Done():
+				a.waiting.Add(-1)
+				timer.Stop()
+				return
+			}
+		}
+		defer func() { <-a.slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(jsonError{Error: message})
+}
+
+// jsonResponse - ответ /json; клиент декодирует именно его, чтобы
+// строгий режим не спотыкался о поле status
+type jsonResponse struct {
+	User
+	Status string `json:"status"`
+}
+
+// jsonHandler на любой мусор во входе отвечает 4xx с JSON-ошибкой, а не 5xx
+func jsonHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body := http.MaxBytesReader(w, r.Body, maxSignedBody)
+
+	user := User{}
+	dec := json.NewDecoder(body)
+	err := dec.Decode(&user)
+	// dec.More() пропускает хвост вида "]" или "}", поэтому ждём именно EOF
+	if err == nil {
+		if _, tokErr := dec.Token(); tokErr != io.EOF {
+			err = errors.New("invalid data after top-level value")
+		}
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jsonResponse{user, "ok"})
+}
+
+const maxSignedBody = 1 << 20
+
+// requestMAC считает HMAC-SHA256 от метода, пути с query, времени и тела
+func requestMAC(secret []byte, method, uri string, ts int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n", method, uri, ts)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func signRequest(req *http.Request, body []byte, secret []byte) {
+	ts := time.Now().Unix()
+	req.Header.Set("X-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Signature", hex.EncodeToString(requestMAC(secret, req.Method, req.URL.RequestURI(), ts, body)))
+}
+
+func withSignature(secret []byte, skew time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts, err := strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+		if err != nil {
+			http.Error(w, "missing or bad X-Timestamp", http.StatusUnauthorized)
+			return
+		}
+		if age := time.Since(time.Unix(ts, 0)); age > skew || age < -skew {
+			http.Error(w, "stale request timestamp", http.StatusUnauthorized)
+			return
+		}
+		sig, err := hex.DecodeString(r.Header.Get("X-Signature"))
+		if err != nil || len(sig) == 0 {
+			http.Error(w, "missing or bad X-Signature", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !hmac.Equal(sig, requestMAC(secret, r.Method, r.URL.RequestURI(), ts, body)) {
+			http.Error(w, "signature mismatch", http.StatusUnauthorized)
+			return
+		}
+
+		// тело уже прочитано - отдаём обработчику копию
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+type envResult struct {
+	Vars map[string]string `json:"vars"`
+	// Absent - разрешённые, но не заданные переменные; пустая строка - это заданная
+	Absent []string `json:"absent"`
+}
+
+// envHandler отдаёт только переменные из allowlist, остальные не читаются вовсе
+func envHandler(allowlist []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := envResult{Vars: map[string]string{}, Absent: []string{}}
+		for _, name := range allowlist {
+			if value, ok := os.LookupEnv(name); ok {
+				res.Vars[name] = value
+			} else {
+				res.Absent = append(res.Absent, name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func withRequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.Atoi(r.Header.Get("X-Request-Timeout"))
+		if err != nil || ms <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := time.Duration(ms) * time.Millisecond
+		if timeout > serverCfg.MaxRequestTimeout {
+			timeout = serverCfg.MaxRequestTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bindQuery заполняет поля структуры dst из r.URL.Query() по тегам
+// query:"name" или query:"name,required"; поддерживаются string, int* и bool
+func bindQuery(r *http.Request, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bindQuery: dst must be a pointer to struct, got %T", dst)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	query := r.URL.Query()
+
+	var errs []error
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag, ok := field.Tag.Lookup("query")
+		if !ok || tag == "-" || !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		raw := query.Get(name)
+		if raw == "" {
+			if opts == "required" {
+				errs = append(errs, fmt.Errorf("query param %q is required", name))
+			}
+			continue
+		}
+		if err := setQueryField(rv.Field(i), raw); err != nil {
+			errs = append(errs, fmt.Errorf("query param %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func setQueryField(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid %s", raw, v.Kind())
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid bool", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+type rootQuery struct {
+	Param  int    `query:"param"`
+	Param2 string `query:"param2"`
+	ID     int    `query:"id"`
+	User   string `query:"user"`
+}
+
+type slowQuery struct {
+	MS int `query:"ms"`
+}
+
+const (
+	pageItems = 10
+	pageSize  = 4
+)
+
+type pageQuery struct {
+	N int `query:"n"`
+}
+
+type page struct {
+	Page  int   `json:"page"`
+	Items []int `json:"items"`
+}
+
+// pageHandler отдаёт элементы 1..pageItems страницами, следующая - в Link rel="next"
+func pageHandler(w http.ResponseWriter, r *http.Request) {
+	q := pageQuery{N: 1}
+	pages := (pageItems + pageSize - 1) / pageSize
+	if err := bindQuery(r, &q); err != nil || q.N < 1 || q.N > pages {
+		http.Error(w, fmt.Sprintf("n must be between 1 and %d", pages), http.StatusBadRequest)
+		return
+	}
+
+	res := page{Page: q.N, Items: []int{}}
+	for i := (q.N-1)*pageSize + 1; i <= min(q.N*pageSize, pageItems); i++ {
+		res.Items = append(res.Items, i)
+	}
+	if q.N > 1 {
+		w.Header().Add("Link", fmt.Sprintf(`</page?n=%d>; rel="prev"`, q.N-1))
+	}
+	if q.N < pages {
+		w.Header().Add("Link", fmt.Sprintf(`</page?n=%d>; rel="next"`, q.N+1))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func slowHandler(w http.ResponseWriter, r *http.Request) {
+	q := slowQuery{MS: 1000}
+	if err := bindQuery(r, &q); err != nil || q.MS < 0 {
+		http.Error(w, "ms must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case <-time.After(time.Duration(q.MS) * time.Millisecond):
+		fmt.Fprintf(w, "slowHandler: done after %dms\n", q.MS)
+	case <-r.Context().Done():
+		http.Error(w, "request timeout", http.StatusServiceUnavailable)
+	}
+}
+
+const maxRandomBytes = 1 << 20
+
+// randomHandler отдаёт n случайных байт в base64: с ?seed= последовательность
+// воспроизводима, без него берётся crypto/rand
+func randomHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	n := 32
+	if rawN := query.Get("n"); rawN != "" {
+		var err error
+		n, err = strconv.Atoi(rawN)
+		if err != nil || n < 0 || n > maxRandomBytes {
+			http.Error(w, fmt.Sprintf("n must be between 0 and %d", maxRandomBytes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var src io.Reader = crand.Reader
+	if rawSeed := query.Get("seed"); rawSeed != "" {
+		seed, err := strconv.ParseUint(rawSeed, 10, 64)
+		if err != nil {
+			http.Error(w, "bad seed", http.StatusBadRequest)
+			return
+		}
+		var key [32]byte
+		binary.LittleEndian.PutUint64(key[:], seed)
+		src = mrand.NewChaCha8(key)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(src, buf); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprint(w, base64.StdEncoding.EncodeToString(buf))
+}
+
+// newUUID собирает UUID версии 4 (RFC 9562) из 16 байт crypto/rand
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(crand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // версия 4
+	b[8] = b[8]&0x3f | 0x80 // вариант 10xx
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+type uuidResult struct {
+	UUID string `json:"uuid"`
+}
+
+func uuidHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := newUUID()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(uuidResult{UUID: id})
+}
+
+type resetQuery struct {
+	Mode string `query:"mode,required"`
+	Key  string `query:"key"`
+}
+
+// resetHandler обрывает ответ на середине тела: mode=eof закрывает соединение
+// обычно (клиент видит unexpected EOF), mode=rst - через RST (ECONNRESET).
+// С ?key= обрывается только первый запрос с этим ключом - для проверки повторов
+type resetHandler struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+const resetBodySize = 1000
+
+func (h *resetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := resetQuery{}
+	if err := bindQuery(r, &q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Mode != "eof" && q.Mode != "rst" {
+		http.Error(w, "mode must be eof or rst", http.StatusBadRequest)
+		return
+	}
+
+	body := bytes.Repeat([]byte{'r'}, resetBodySize)
+	if q.Key != "" {
+		h.mu.Lock()
+		if h.seen == nil {
+			h.seen = map[string]bool{}
+		}
+		again := h.seen[q.Key]
+		h.seen[q.Key] = true
+		h.mu.Unlock()
+		if again {
+			w.Write(body)
+			return
+		}
+	}
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nContent-Type: text/plain\r\n\r\n", resetBodySize)
+	buf.Write(body[:resetBodySize/10])
+	buf.Flush()
+	// даём клиенту прочитать начало тела, прежде чем оборвать
+	time.Sleep(20 * time.Millisecond)
+
+	if q.Mode == "rst" {
+		// SetLinger(0) превращает Close в RST вместо FIN
+		for c := conn; ; {
+			if tcp, ok := c.(*net.TCPConn); ok {
+				tcp.SetLinger(0)
+				break
+			}
+			inner, ok := c.(interface{ NetConn() net.Conn })
+			if !ok {
+				break
+			}
+			c = inner.NetConn()
+		}
+	}
+	conn.Close()
+}
+
+// greetingPage экранирует данные сам: html/template знает контекст
+// (текст, атрибут, URL) и подбирает экранирование под него
+var greetingPage = template.Must(template.New("greeting").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Hello, {{.Name}}</title></head>
+<body>
+<h1>Hello, {{.Name}}!</h1>
+<p><a href="/template?name={{.Name}}">link to this page</a></p>
+</body>
+</html>
+`))
+
+type greetingQuery struct {
+	Name string `query:"name"`
+}
+
+func templateHandler(w http.ResponseWriter, r *http.Request) {
+	q := greetingQuery{Name: "guest"}
+	if err := bindQuery(r, &q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// рендерим в буфер, чтобы ошибка шаблона не оставила полстраницы с кодом 200
+	buf := &bytes.Buffer{}
+	if err := greetingPage.Execute(buf, q); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+const maxDownloadBytes = 64 << 20
+
+func downloadData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+// downloadHandler отдаёт ?size= байт; ServeContent сам обрабатывает Range
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	size := 1 << 20
+	if rawSize := r.URL.Query().Get("size"); rawSize != "" {
+		var err error
+		size, err = strconv.Atoi(rawSize)
+		if err != nil || size < 0 || size > maxDownloadBytes {
+			http.Error(w, fmt.Sprintf("size must be between 0 and %d", maxDownloadBytes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "download.bin", time.Time{}, bytes.NewReader(downloadData(size)))
+}
+
+type validationResult struct {
+	Valid   bool   `json:"valid"`
+	Offset  *int64 `json:"offset,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// locateJSONError ищет, на каком байте ломается невалидный JSON
+func locateJSONError(body []byte) (int64, string) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var v interface{}
+	err := dec.Decode(&v)
+
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return syntaxErr.Offset, syntaxErr.Error()
+	case err != nil:
+		// io.EOF и io.ErrUnexpectedEOF - документ оборвался
+		return int64(len(body)), "unexpected end of JSON input"
+	}
+
+	// первое значение разобралось, значит после него лишние данные
+	return dec.InputOffset(), "invalid data after top-level value"
+}
+
+func validateJSONHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	res := validationResult{Valid: json.Valid(body)}
+	if !res.Valid {
+		offset, message := locateJSONError(body)
+		res.Offset, res.Message = &offset, message
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+// flightGroup склеивает одинаковые одновременные вызовы в один
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+func (g *flightGroup) Do(key string, fn func() ([]byte, error)) ([]byte, error, bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.val, call.err, false
+}
+
+type expensiveResult struct {
+	Result       string `json:"result"`
+	Shared       bool   `json:"shared"`
+	Computations int64  `json:"computations"`
+}
+
+type expensiveHandler struct {
+	group        flightGroup
+	computations atomic.Int64
+}
+
+func (h *expensiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// не привязываемся к контексту запроса: результат нужен всем ожидающим
+	val, err, shared := h.group.Do(r.URL.RequestURI(), func() ([]byte, error) {
+		h.computations.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		sum := sha256.Sum256([]byte(r.URL.RawQuery))
+		return sum[:], nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(expensiveResult{
+		Result:       hex.EncodeToString(val),
+		Shared:       shared,
+		Computations: h.computations.Load(),
+	})
+}
+
+type countResult struct {
+	Count    int64 `json:"count"`
+	Previous int64 `json:"previous,omitempty"`
+}
+
+// countHandler: GET увеличивает общий счётчик, DELETE сбрасывает его в ноль
+type countHandler struct {
+	count atomic.Int64
+}
+
+func (h *countHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := countResult{}
+	switch r.Method {
+	case http.MethodGet:
+		res.Count = h.count.Add(1)
+	case http.MethodDelete:
+		res.Previous = h.count.Swap(0)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+type Change struct {
+	From        interface{} `json:"from"`
+	To          interface{} `json:"to"`
+	TypeChanged bool        `json:"type_changed,omitempty"`
+}
+
+// DiffResult - ключи записаны путями через точку, например "address.city"
+type DiffResult struct {
+	Added   map[string]interface{} `json:"added"`
+	Removed map[string]interface{} `json:"removed"`
+	Changed map[string]Change      `json:"changed"`
+}
+
+func jsonDiff(a, b interface{}) DiffResult {
+	res := DiffResult{
+		Added:   map[string]interface{}{},
+		Removed: map[string]interface{}{},
+		Changed: map[string]Change{},
+	}
+	diffValues("", a, b, &res)
+	return res
+}
+
+func diffValues(path string, a, b interface{}, res *DiffResult) {
+	aObj, aIsObj := a.(map[string]interface{})
+	bObj, bIsObj := b.(map[string]interface{})
+	if !aIsObj || !bIsObj {
+		// массивы и скаляры сравниваем целиком
+		if !reflect.DeepEqual(a, b) {
+			res.Changed[path] = Change{From: a, To: b, TypeChanged: jsonType(a) != jsonType(b)}
+		}
+		return
+	}
+
+	for key, aVal := range aObj {
+		bVal, ok := bObj[key]
+		if !ok {
+			res.Removed[joinPath(path, key)] = aVal
+			continue
+		}
+		diffValues(joinPath(path, key), aVal, bVal, res)
+	}
+	for key, bVal := range bObj {
+		if _, ok := aObj[key]; !ok {
+			res.Added[joinPath(path, key)] = bVal
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+type diffRequest struct {
+	A map[string]interface{} `json:"a"`
+	B map[string]interface{} `json:"b"`
+}
+
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	req := diffRequest{}
+	err := decodeJSON(r.Body, &req, false)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.A == nil || req.B == nil {
+		http.Error(w, `both "a" and "b" must be JSON objects`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jsonDiff(req.A, req.B))
+}
+
+// jsonFields раскладывает структуру по именам из тегов json;
+// поля с тегом "-" и неэкспортируемые пропускаются
+func jsonFields(v interface{}) map[string]interface{} {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+	fields := map[string]interface{}{}
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = rv.Field(i).Interface()
+	}
+	return fields
+}
+
+type selectionRequest struct {
+	Fields []string `json:"fields"`
+}
+
+type selectionError struct {
+	Error   string   `json:"error"`
+	Unknown []string `json:"unknown,omitempty"`
+}
+
+// selectionUser - фиксированный объект, поля которого можно выбирать через /graphql-lite
+var selectionUser = User{ID: 42, User: "rvasily", Email: "rvasily@example.com"}
+
+func selectionHandler(w http.ResponseWriter, r *http.Request) {
+	req := selectionRequest{}
+	err := decodeJSON(http.MaxBytesReader(w, r.Body, 1<<16), &req, true)
+	defer r.Body.Close()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Fields) == 0 {
+		writeJSONError(w, http.StatusBadRequest, `"fields" must list at least one field`)
+		return
+	}
+
+	available := jsonFields(selectionUser)
+	res := map[string]interface{}{}
+	unknown := []string{}
+	for _, name := range req.Fields {
+		value, ok := available[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		res[name] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(unknown) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(selectionError{Error: "unknown fields", Unknown: unknown})
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+const maxKVValue = 1 << 20
+
+// kvStore - map в памяти, которая сбрасывается в JSON-файл после изменений
+type kvStore struct {
+	mu   sync.RWMutex
+	data map[string]json.RawMessage
+
+	path  string
+	delay time.Duration
+	// flushMu держит таймер и не даёт двум сбросам писать файл одновременно
+	flushMu sync.Mutex
+	timer   *time.Timer
+}
+
+// loadKVStore читает path; битый файл откладывается в сторону
+// (path.corrupt-<время>) и хранилище стартует пустым. Без path
+// хранилище живёт только в памяти
+func loadKVStore(path string, delay time.Duration) (*kvStore, error) {
+	s := &kvStore{data: map[string]json.RawMessage{}, path: path, delay: delay}
+	if path == "" {
+		return s, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		backup := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+		logger.Warn("kv file is corrupt, starting empty", "path", path, "backup", backup, "err", err)
+		s.data = map[string]json.RawMessage{}
+		if err := os.Rename(path, backup); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *kvStore) get(key string) (json.RawMessage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.data[key]
+	return value, ok
+}
+
+func (s *kvStore) set(key string, value json.RawMessage) {
+	s.mu.Lock()
+	s.data[key] = value
+	s.mu.Unlock()
+	s.scheduleFlush()
+}
+
+func (s *kvStore) delete(key string) bool {
+	s.mu.Lock()
+	_, ok := s.data[key]
+	delete(s.data, key)
+	s.mu.Unlock()
+	if ok {
+		s.scheduleFlush()
+	}
+	return ok
+}
+
+func (s *kvStore) scheduleFlush() {
+	if s.path == "" {
+		return
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.delay, func() {
+			if err := s.flush(); err != nil {
+				logger.Error("kv flush failed", "path", s.path, "err", err)
+			}
+		})
+	}
+}
+
+// flush пишет снимок через временный файл и rename, так что файл
+// на диске всегда либо старый, либо новый целиком
+func (s *kvStore) flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *kvStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := s.get(key)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(value)
+
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxKVValue))
+		r.Body.Close()
+		if err != nil {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if !json.Valid(value) {
+			writeJSONError(w, http.StatusBadRequest, "value must be valid JSON")
+			return
+		}
+		s.set(key, json.RawMessage(value))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !s.delete(key) {
+			writeJSONError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// version подменяется при сборке: go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"version": version, "go": runtime.Version()})
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+type subResult struct {
+	Status     string          `json:"status"` // "ok" или "error"
+	HTTPStatus int             `json:"http_status,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+type aggregateResult struct {
+	OK      bool                 `json:"ok"`
+	Results map[string]subResult `json:"results"`
+}
+
+// aggregateHandler параллельно опрашивает собственные эндпоинты сервера
+// и собирает их JSON в один ответ; упавший подзапрос помечается error,
+// но остальные результаты всё равно возвращаются
+type aggregateHandler struct {
+	client  *http.Client
+	timeout time.Duration
+}
+
+// newAggregateHandler обслуживает подзапросы прямо в процессе через mux:
+// admission control, rate limiter и limitListener их не видят, иначе
+// один /aggregate занимал бы несколько слотов и мог бы отказать сам себе
+func newAggregateHandler(mux http.Handler, timeout time.Duration) *aggregateHandler {
+	return &aggregateHandler{client: &http.Client{Transport: handlerTransport{mux}}, timeout: timeout}
+}
+
+func (h *aggregateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// хост не важен: handlerTransport не ходит в сеть
+	const base = "http://aggregate.internal"
+
+	paths := map[string]string{
+		"version": "/version",
+		"healthz": "/healthz",
+		"count":   "/count",
+	}
+	// ?slow=ms добавляет подзапрос, который не уложится в таймаут
+	if ms := r.URL.Query().Get("slow"); ms != "" {
+		paths["slow"] = "/slow?ms=" + neturl.QueryEscape(ms)
+	}
+
+	res := aggregateResult{OK: true, Results: map[string]subResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub := h.fetch(r.Context(), base+path)
+			mu.Lock()
+			res.Results[name] = sub
+			res.OK = res.OK && sub.Status == "ok"
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *aggregateHandler) fetch(ctx context.Context, url string) (sub subResult) {
+	start := time.Now()
+	defer func() { sub.DurationMS = time.Since(start).Milliseconds() }()
+	fail := func(err error) subResult {
+		sub.Status, sub.Error = "error", err.Error()
+		return sub
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fail(err)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fail(classifyErr(err))
+	}
+	defer resp.Body.Close()
+
+	sub.HTTPStatus = resp.StatusCode
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fail(classifyErr(err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("unexpected status %s", resp.Status))
+	}
+	if !json.Valid(body) {
+		return fail(errors.New("response is not JSON"))
+	}
+	sub.Status, sub.Data = "ok", body
+	return sub
+}
+
+// handlerTransport отдаёт запрос обработчику напрямую, без сети
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.handler.ServeHTTP(w, req)
+	}()
+	// обработчик, который не смотрит на контекст, дорабатывает в фоне:
+	// его ответ уже никто не прочитает
+	select {
+	case <-done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// bufferedResponse копит ответ обработчика в памяти
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = code, true
+	}
+}
+
+func (w *bufferedResponse) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(p)
+}
+
+type sleepStreamQuery struct {
+	Delay    int `query:"delay"`
+	Chunks   int `query:"chunks"`
+	Interval int `query:"interval"`
+}
+
+// sleepThenStreamHandler сначала молчит delay мс (заголовки ещё не ушли),
+// затем шлёт chunks кусков раз в interval мс. Отмена на любом этапе
+// видна через r.Context() и сразу прекращает работу
+func sleepThenStreamHandler(w http.ResponseWriter, r *http.Request) {
+	q := sleepStreamQuery{Delay: 500, Chunks: 10, Interval: 100}
+	if err := bindQuery(r, &q); err != nil || q.Delay < 0 || q.Chunks < 0 || q.Interval < 0 {
+		http.Error(w, "delay, chunks and interval must be non-negative integers", http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+
+	select {
+	case <-time.After(time.Duration(q.Delay) * time.Millisecond):
+	case <-r.Context().Done():
+		logger.Info("sleep-then-stream cancelled before headers", "after", time.Since(start), "err", r.Context().Err())
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for i := 1; i <= q.Chunks; i++ {
+		fmt.Fprintf(w, "chunk %d\n", i)
+		if err := rc.Flush(); err != nil {
+			logger.Error("sleep-then-stream flush failed", "chunk", i, "err", err)
+			return
+		}
+		if i == q.Chunks {
+			break
+		}
+
+		select {
+		case <-time.After(time.Duration(q.Interval) * time.Millisecond):
+		case <-r.Context().Done():
+			logger.Info("sleep-then-stream cancelled mid-stream", "sent", i, "of", q.Chunks, "after", time.Since(start), "err", r.Context().Err())
+			return
+		}
+	}
+}
+
+type uploadResult struct {
+	Bytes            int64    `json:"bytes"`
+	SHA256           string   `json:"sha256"`
+	TransferEncoding []string `json:"transfer_encoding"`
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// решаем по заголовкам, пока тело не читали: сервер отправляет
+	// 100 Continue только при первом чтении r.Body, так что клиент
+	// с Expect: 100-continue тело так и не пошлёт
+	if limit := serverCfg.MaxUploadBytes; limit > 0 && r.ContentLength > limit {
+		status := http.StatusRequestEntityTooLarge
+		if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+			status = http.StatusExpectationFailed
+		}
+		http.Error(w, fmt.Sprintf("upload of %d bytes exceeds limit of %d", r.ContentLength, limit), status)
+		return
+	}
+	if serverCfg.MaxUploadBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, serverCfg.MaxUploadBytes)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, r.Body)
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadResult{
+		Bytes:            n,
+		SHA256:           hex.EncodeToString(hash.Sum(nil)),
+		TransferEncoding: r.TransferEncoding,
+	})
+}
+
+// closeHandler сам просит закрыть соединение после ответа
+func closeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "close")
+	fmt.Fprintf(w, "closeHandler: connection will be closed\n")
+}
+
+// slowlorisGuardHandler - цель для runSlowloris: сюда доходят только клиенты,
+// уложившиеся с заголовками в ReadHeaderTimeout
+func slowlorisGuardHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "slowlorisGuardHandler: headers arrived within %v\n", serverCfg.ReadHeaderTimeout)
+}
+
+func startServer(ctx context.Context, addr chan string) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		q := rootQuery{}
+		if err := bindQuery(r, &q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintf(w, "getHandler: incoming request\n")
+		fmt.Fprintf(w, "getHandler: r.Url %#v\n", r.URL)
+		fmt.Fprintf(w, "getHandler: query %+v\n", q)
+	})
+
+	mux.HandleFunc("/raw_body", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprintf(w, "postHandler: raw body %s\n", string(body))
+	})
+
+	mux.Handle("/json", withSignature(serverCfg.SigningSecret, serverCfg.SignatureSkew, http.HandlerFunc(jsonHandler)))
+
+	mux.HandleFunc("/slow", slowHandler)
+	mux.HandleFunc("GET /sleep-then-stream", sleepThenStreamHandler)
+	mux.HandleFunc("GET /page", pageHandler)
+
+	users := newUserStore()
+	mux.Handle("GET /users/{id}", withCSRF(http.HandlerFunc(users.handleGet)))
+	mux.Handle("PUT /users/{id}", withCSRF(http.HandlerFunc(users.handleUpdate)))
+	mux.Handle("PATCH /users/{id}", withCSRF(http.HandlerFunc(users.handleUpdate)))
+
+	mux.HandleFunc("/close", closeHandler)
+	mux.HandleFunc("GET /slowloris-guard", slowlorisGuardHandler)
+
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	})
+
+	mux.HandleFunc("/random", randomHandler)
+	mux.HandleFunc("GET /uuid", uuidHandler)
+	mux.HandleFunc("GET /template", templateHandler)
+	mux.Handle("GET /reset", &resetHandler{})
+	mux.HandleFunc("POST /upload", uploadHandler)
+	mux.HandleFunc("/download", downloadHandler)
+	mux.HandleFunc("POST /validate-json", validateJSONHandler)
+	mux.HandleFunc("POST /diff", diffHandler)
+	mux.HandleFunc("POST /graphql-lite", selectionHandler)
+	mux.Handle("/expensive", &expensiveHandler{})
+	mux.Handle("/count", &countHandler{})
+	mux.HandleFunc("GET /version", versionHandler)
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.Handle("GET /aggregate", newAggregateHandler(mux, serverCfg.AggregateTimeout))
+
+	kv, err := loadKVStore(serverCfg.KVPath, serverCfg.KVFlushDelay)
+	if err != nil {
+		logger.Error("kv load failed", "path", serverCfg.KVPath, "err", err)
+		return
+	}
+	mux.Handle("/kv/{key}", kv)
+
+	var admission *admissionControl
+	if serverCfg.MaxInFlight > 0 {
+		admission = newAdmissionControl(serverCfg.MaxInFlight, serverCfg.QueueSize, serverCfg.QueueWait)
+	}
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]interface{}{}
+		if admission != nil {
+			res["admission"] = admission.metrics()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	auth := newAuthenticator(serverCfg.AuthSchemes)
+	mux.Handle("GET /whoami", withAuth(auth, http.HandlerFunc(whoamiHandler)))
+	mux.Handle("GET "+maintenancePath, withAuth(auth, http.HandlerFunc(maintenanceHandler)))
+	mux.Handle("PUT "+maintenancePath, withAuth(auth, http.HandlerFunc(maintenanceHandler)))
+
+	mux.HandleFunc("GET /env", envHandler(serverCfg.EnvAllowlist))
+	mux.HandleFunc("/time", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, time.Now().Format(time.RFC3339Nano))
+	})
+
+	stats := newLatencyStats()
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"routes": stats.snapshot()})
+	})
+
+	conns := newConnLimiter(serverCfg.MaxRequestsPerConn, serverCfg.MaxConnAge)
+	drain := newDrainState()
+	mux.HandleFunc("GET /shutdown-status", shutdownStatusHandler(conns, drain, serverCfg.ShutdownTimeout))
+
+	handler := withLogging(stats, mux)
+	if serverCfg.Chaos.enabled() {
+		handler = withChaos(serverCfg.Chaos, handler)
+	}
+	if admission != nil {
+		handler = admission.wrap(handler)
+	}
+	handler = withMaintenance(handler)
+	handler = withLiveConfig(&rateLimiter{}, handler)
+	handler = withRequestTimeout(handler)
+	handler = conns.wrap(handler)
+	handler = withTracing(handler)
+	handler = withRequestContext(handler)
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+		IdleTimeout:       serverCfg.IdleTimeout,
+		ConnContext:       conns.connContext,
+		ConnState:         conns.connState,
+	}
+	server.RegisterOnShutdown(drain.begin)
+	var listener net.Listener
+	listener, err = net.Listen("tcp", serverCfg.Addr)
+	if err != nil {
+		logger.Error("listen failed", "err", err)
+		return
+	}
+	if serverCfg.MaxConns > 0 {
+		listener = newLimitListener(listener, serverCfg.MaxConns)
+	}
+
+	// не блокируемся навсегда, если адрес уже никто не ждёт
+	select {
+	case addr <- listener.Addr().String():
+	case <-ctx.Done():
+		listener.Close()
+		return
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		// даём активным запросам доработать, потом закрываем принудительно
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverCfg.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("graceful shutdown timed out", "err", err, "active", conns.active())
+			server.Close()
+		}
+		// запросов больше не будет - сбрасываем то, что не дождалось таймера
+		if err := kv.flush(); err != nil {
+			logger.Error("kv flush failed", "path", serverCfg.KVPath, "err", err)
+		}
+		logger.Info("server drained")
+	}()
+
+	logger.Info("server listening", "addr", listener.Addr().String(), "max_conns", serverCfg.MaxConns)
+	err = server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("server stopped", "err", err)
+		return
+	}
+	// Serve возвращается сразу после начала Shutdown, а не после его конца
+	<-drained
+}
+
+// selfSignedCert выпускает сертификат для 127.0.0.1/localhost и пул,
+// которому клиент должен доверять
+func selfSignedCert() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots, nil
+}
+
+func startTLSServer(ctx context.Context, cert tls.Certificate, addr chan string) {
 	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "tlsHandler: %s\n", r.Proto)
+	})
+
+	server := &http.Server{
+		Handler:   withRequestContext(withLogging(nil, mux)),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logger.Error("listen failed", "err", err)
+		return
+	}
+
+	select {
+	case addr <- listener.Addr().String():
+	case <-ctx.Done():
+		listener.Close()
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	// ServeTLS сам добавляет h2 в ALPN
+	err = server.ServeTLS(listener, "", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("tls server stopped", "err", err)
+	}
+}
+
+var ErrRequestTimeout = errors.New("request timed out")
+
+// ErrDNSLookup - имя хоста не разрешилось; *net.DNSError остаётся в цепочке
+var ErrDNSLookup = errors.New("dns lookup failed")
+
+// ErrConnectionReset - соединение оборвалось посреди ответа
+var ErrConnectionReset = errors.New("connection reset")
+
+func isConnReset(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return os.IsTimeout(err)
+}
+
+// classifyErr заменяет "сырые" сетевые ошибки клиента на сигнальные,
+// которые удобно проверять через errors.Is; исходная ошибка остаётся в цепочке
+func classifyErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && !errors.Is(err, ErrDNSLookup) {
+		err = fmt.Errorf("%w for %s: %w", ErrDNSLookup, dnsErr.Name, err)
+	}
+	if isConnReset(err) && !errors.Is(err, ErrConnectionReset) {
+		err = fmt.Errorf("%w: %w", ErrConnectionReset, err)
+	}
+	if isTimeout(err) && !errors.Is(err, ErrRequestTimeout) {
+		return fmt.Errorf("%w: %w", ErrRequestTimeout, err)
+	}
+	return err
+}
+
+// Client - обёртка над http.Client с базовым URL, общими заголовками и повторами
+type Client struct {
+	timeout   time.Duration
+	transport http.RoundTripper
+	baseURL   string
+	header    http.Header
+	retries   int
+
+	http *http.Client
+}
+
+type Option func(*Client)
+
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) { c.transport = rt }
+}
+
+// WithBaseURL задаёт префикс для относительных путей в Get/Post
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) { c.baseURL = strings.TrimSuffix(baseURL, "/") }
+}
+
+func WithDefaultHeader(key, value string) Option {
+	return func(c *Client) { c.header.Set(key, value) }
+}
+
+// WithRetries - сколько раз повторить запрос после сетевой ошибки или 502/503/504.
+// Повторяются только идемпотентные методы: POST мог уже дойти до сервера
+func WithRetries(n int) Option {
+	return func(c *Client) { c.retries = n }
+}
+
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		timeout:   10 * time.Second,
+		transport: http.DefaultTransport,
+		header:    http.Header{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.http = &http.Client{Timeout: c.timeout, Transport: traced(c.transport)}
+	return c
+}
+
+func (c *Client) Get(ctx context.Context, path string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, path, "", nil)
+}
+
+func (c *Client) Post(ctx context.Context, path, contentType string, body []byte) (*http.Response, error) {
+	return c.do(ctx, http.MethodPost, path, contentType, body)
+}
+
+func (c *Client) PostJSON(ctx context.Context, path string, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, http.MethodPost, path, "application/json", body)
+}
+
+// GetBytes читает тело целиком; обрыв посреди тела (ErrConnectionReset)
+// повторяется так же, как сетевые ошибки в do
+func (c *Client) GetBytes(ctx context.Context, path string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.Get(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = classifyErr(err)
+		if err == nil {
+			return body, nil
+		}
+		if !errors.Is(err, ErrConnectionReset) || attempt >= c.retries || ctx.Err() != nil {
+			// частичное тело вместе с ошибкой не отдаём
+			return nil, err
+		}
+		logger.Debug("retrying request", "method", http.MethodGet, "url", c.url(path), "attempt", attempt+1, "err", err)
+	}
+}
+
+func (c *Client) url(path string) string {
+	if c.baseURL == "" || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return c.baseURL + path
+}
+
+// idempotentMethod - повтор такого запроса не меняет результат на сервере
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// do держит тело в памяти, чтобы каждый повтор отправлял его заново
+func (c *Client) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	url := c.url(path)
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range c.header {
+			req.Header[key] = values
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err := c.http.Do(req)
+		retry := idempotentMethod(method) && (err != nil || retryableStatus(resp.StatusCode))
+		if !retry || attempt >= c.retries || ctx.Err() != nil {
+			if err != nil {
+				return nil, classifyErr(err)
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		logger.Debug("retrying request", "method", method, "url", url, "attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(time.Duration(attempt+1) * 100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, classifyErr(ctx.Err())
+		}
+	}
+}
+
+// opts у трёх базовых демо позволяют подменить транспорт, например на запись/воспроизведение
+func runGet(ctx context.Context, serverURL string, opts ...Option) {
+	client := NewClient(append([]Option{WithBaseURL(serverURL)}, opts...)...)
+	path := "/?param=123&param2=test"
+	start := time.Now()
+	resp, err := client.Get(ctx, path)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", client.url(path), "duration", time.Since(start), "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	logger.Info("http.Get", "url", client.url(path), "duration", time.Since(start), "body", string(respBody))
+}
+
+func runGetFullReq(ctx context.Context, serverURL string, opts ...Option) {
+	client := NewClient(append([]Option{
+		WithBaseURL(serverURL),
+		WithDefaultHeader("User-Agent", "coursera/golang"),
+		WithRetries(2),
+	}, opts...)...)
+	path := "/?id=42&user=rvasily"
+
+	start := time.Now()
+	resp, err := client.Get(ctx, path)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", client.url(path), "duration", time.Since(start), "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	logger.Info("testGetFullReq", "url", client.url(path), "duration", time.Since(start), "body", string(respBody))
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// retryableDialErr - сервер, скорее всего, ещё поднимается. DNS-ошибки,
+// таймауты и прочее повтор не исправит
+func retryableDialErr(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryDial повторяет только установку соединения - сам запрос ещё не отправлен,
+// поэтому это безопасно даже для POST, в отличие от повторов уровня Client
+func retryDial(dial dialFunc, retries int, backoff time.Duration) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		for attempt := 0; ; attempt++ {
+			conn, err := dial(ctx, network, addr)
+			if err == nil || !retryableDialErr(err) || attempt >= retries || ctx.Err() != nil {
+				return conn, err
+			}
+
+			wait := backoff << attempt
+			logger.Debug("dial failed, retrying", "addr", addr, "attempt", attempt+1, "wait", wait, "err", err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+func newPooledTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		DialContext:  retryDial(dialer.DialContext, clientCfg.DialRetries, clientCfg.DialBackoff),
+		MaxIdleConns: 100,
+	}
+}
+
+func newPooledClient() *http.Client {
+	return &http.Client{
+		Timeout:   time.Second * 10,
+		Transport: traced(newPooledTransport()),
+	}
+}
+
+func newTLSClient(roots *x509.CertPool, forceHTTP1 bool) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		// со своим TLSClientConfig HTTP/2 включается только явно
+		ForceAttemptHTTP2: true,
+	}
+	if forceHTTP1 {
+		// пустая, но не nil карта отключает переход на HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &http.Client{
+		Timeout:   time.Second * 10,
+		Transport: traced(transport),
+	}
+}
+
+// runProtocols печатает версию протокола в обоих режимах: HTTP/2.0 по
+// умолчанию и HTTP/1.1 при ForceHTTP1; первым идёт режим из -http1
+func runProtocols(tlsURL string, roots *x509.CertPool) {
+	for _, forceHTTP1 := range []bool{clientCfg.ForceHTTP1, !clientCfg.ForceHTTP1} {
+		c := newTLSClient(roots, forceHTTP1)
+		resp, err := c.Get(tlsURL)
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", tlsURL, "force_http1", forceHTTP1, "err", classifyErr(err))
+			return
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		logger.Info("runProtocols",
+			"url", tlsURL,
+			"force_http1", forceHTTP1,
+			"configured", forceHTTP1 == clientCfg.ForceHTTP1,
+			"proto", resp.Proto,
+			"body", strings.TrimSpace(string(respBody)))
+	}
+}
+
+func runTransportAndPost(ctx context.Context, serverURL string, opts ...Option) {
+	client := NewClient(append([]Option{
+		WithBaseURL(serverURL),
+		WithTransport(newPooledTransport()),
+		WithTimeout(5 * time.Second),
+	}, opts...)...)
+
+	data := []byte(`{"id": 42, "user": "rvasily"}`)
+	url := client.url("/raw_body")
+
+	start := time.Now()
+	resp, err := client.Post(ctx, "/raw_body", "application/json", data)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodPost, "url", url, "duration", time.Since(start), "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	logger.Info("runTransport", "url", url, "duration", time.Since(start), "body", string(respBody))
+}
+
+// exchange - одна пара запрос/ответ в записи; тела в JSON идут как base64
+type exchange struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    []byte      `json:"request_body,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header"`
+	ResponseBody   []byte      `json:"response_body,omitempty"`
+}
+
+// RecordingTransport пропускает запросы в Base и запоминает каждую пару запрос/ответ
+type RecordingTransport struct {
+	Base http.RoundTripper
+
+	mu        sync.Mutex
+	exchanges []exchange
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// RoundTrip не должен менять исходный запрос, поэтому тело - в копии
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	t.mu.Lock()
+	t.exchanges = append(t.exchanges, exchange{
+		Method:         req.Method,
+		URL:            req.URL.String(),
+		RequestHeader:  req.Header.Clone(),
+		RequestBody:    reqBody,
+		Status:         resp.StatusCode,
+		ResponseHeader: resp.Header.Clone(),
+		ResponseBody:   respBody,
+	})
+	t.mu.Unlock()
+	return resp, nil
+}
+
+// Save пишет запись в файл через временный, чтобы не оставить обрывок
+func (t *RecordingTransport) Save(path string) error {
+	t.mu.Lock()
+	data, err := json.MarshalIndent(t.exchanges, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+var errNoRecording = errors.New("replay: no recorded response")
+
+// ReplayTransport отвечает из записи и никуда не ходит по сети; одинаковые
+// запросы получают записанные ответы по очереди. Запрос сопоставляется по
+// методу, пути, query и телу - хост и порт записи не важны
+type ReplayTransport struct {
+	mu        sync.Mutex
+	exchanges []exchange
+	keys      []string
+	used      []bool
+}
+
+// replayKey - путь и query в каноническом порядке параметров
+func replayKey(u *neturl.URL) string {
+	return u.EscapedPath() + "?" + u.Query().Encode()
+}
+
+func NewReplayTransport(path string) (*ReplayTransport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &ReplayTransport{}
+	if err := json.Unmarshal(data, &t.exchanges); err != nil {
+		return nil, fmt.Errorf("replay: bad recording %s: %w", path, err)
+	}
+	for _, ex := range t.exchanges {
+		u, err := neturl.Parse(ex.URL)
+		if err != nil {
+			return nil, fmt.Errorf("replay: bad recording %s: %w", path, err)
+		}
+		t.keys = append(t.keys, replayKey(u))
+	}
+	t.used = make([]bool, len(t.exchanges))
+	return t, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := replayKey(req.URL)
+	for i, ex := range t.exchanges {
+		if t.used[i] || ex.Method != req.Method || t.keys[i] != key || !bytes.Equal(ex.RequestBody, reqBody) {
+			continue
+		}
+		t.used[i] = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+			StatusCode:    ex.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        ex.ResponseHeader.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(ex.ResponseBody)),
+			ContentLength: int64(len(ex.ResponseBody)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w for %s %s", errNoRecording, req.Method, req.URL)
+}
+
+// runRecordReplay записывает три базовых демо на живом сервере,
+// затем проигрывает их из файла без сети
+func runRecordReplay(ctx context.Context, serverURL string) {
+	dir, err := os.MkdirTemp("", "transcript")
+	if err != nil {
+		logger.Error("temp dir failed", "err", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "transcript.json")
+
+	recorder := &RecordingTransport{Base: http.DefaultTransport}
+	runGet(ctx, serverURL, WithTransport(recorder))
+	runGetFullReq(ctx, serverURL, WithTransport(recorder))
+	runTransportAndPost(ctx, serverURL, WithTransport(recorder))
+	if err := recorder.Save(path); err != nil {
+		logger.Error("save transcript failed", "path", path, "err", err)
+		return
+	}
+
+	replay, err := NewReplayTransport(path)
+	if err != nil {
+		logger.Error("load transcript failed", "path", path, "err", err)
+		return
+	}
+	// адрес, где никто не слушает: ответы приходят только из записи
+	const offlineURL = "http://replay.invalid"
+	runGet(ctx, offlineURL, WithTransport(replay))
+	runGetFullReq(ctx, offlineURL, WithTransport(replay))
+	runTransportAndPost(ctx, offlineURL, WithTransport(replay))
+
+	// запроса нет в записи - ReplayTransport должен отказать, а не идти в сеть
+	_, err = NewClient(WithBaseURL(offlineURL), WithTransport(replay)).Get(ctx, "/never-recorded")
+	logger.Info("runRecordReplay",
+		"path", path,
+		"recorded", len(recorder.exchanges),
+		"unmatched_rejected", errors.Is(err, errNoRecording),
+		"err", err)
+}
+
+func runJSON(serverURL string) {
+	url := serverURL + "/json"
+	data := []byte(`{"id": 42, "user": "rvasily"}`)
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	signRequest(req, data, clientCfg.SigningSecret)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodPost, "url", url, "duration", time.Since(start), "err", classifyErr(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	res := jsonResponse{}
+	err = decodeJSON(resp.Body, &res, clientCfg.StrictJSON)
+	if err != nil {
+		logger.Error("decode failed", "url", url, "strict", clientCfg.StrictJSON, "err", err)
+		return
+	}
+	logger.Info("runJSON", "url", url, "duration", time.Since(start), "user", res.User, "status", res.Status)
+}
+
+// runTamperedJSON подписывает одно тело, а отправляет другое
+func runTamperedJSON(serverURL string) {
+	url := serverURL + "/json"
+	signed := []byte(`{"id": 42, "user": "rvasily"}`)
+	sent := []byte(`{"id": 42, "user": "admin"}`)
+
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(sent))
+	req.Header.Set("Content-Type", "application/json")
+	signRequest(req, signed, clientCfg.SigningSecret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("request failed", "method", req.Method, "url", url, "err", classifyErr(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	logger.Info("runTamperedJSON", "url", url, "status", resp.StatusCode, "body", strings.TrimSpace(string(respBody)))
+}
+
+func setRequestTimeout(req *http.Request, timeout time.Duration) {
+	req.Header.Set("X-Request-Timeout", strconv.FormatInt(timeout.Milliseconds(), 10))
+}
+
+func runSlow(serverURL string) {
+	url := serverURL + "/slow?ms=500"
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	setRequestTimeout(req, 100*time.Millisecond)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("request failed", "method", req.Method, "url", url, "duration", time.Since(start), "err", classifyErr(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	logger.Info("runSlow", "url", url, "status", resp.StatusCode, "duration", time.Since(start), "body", string(respBody))
+}
+
+// runConnectionReset читает ответы, которые сервер обрывает на середине тела
+func runConnectionReset(ctx context.Context, serverURL string) {
+	client := NewClient(WithBaseURL(serverURL), WithRetries(1))
+	for _, path := range []string{"/reset?mode=eof", "/reset?mode=rst", "/reset?mode=rst&key=retry-demo"} {
+		body, err := client.GetBytes(ctx, path)
+		logger.Info("runConnectionReset",
+			"url", client.url(path),
+			"bytes", len(body),
+			"reset", errors.Is(err, ErrConnectionReset),
+			"err", err)
+	}
+}
+
+// runDialRetry начинает подключаться к порту, на котором сервер поднимется
+// только через 200мс; без retryDial первый же dial получил бы connection refused
+func runDialRetry(ctx context.Context) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logger.Error("listen failed", "err", err)
+		return
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	late := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "up")
+	})}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger.Error("listen failed", "addr", addr, "err", err)
+			return
+		}
+		late.Serve(ln)
+	}()
+	defer late.Close()
+
+	var dials atomic.Int64
+	base := (&net.Dialer{Timeout: time.Second}).DialContext
+	counted := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return base(ctx, network, addr)
+	}
+	transport := &http.Transport{DialContext: retryDial(counted, clientCfg.DialRetries, clientCfg.DialBackoff)}
+	client := NewClient(WithTransport(transport))
+
+	url := "http://" + addr + "/"
+	start := time.Now()
+	body, err := client.GetBytes(ctx, url)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", url, "dials", dials.Load(), "err", err)
+		return
+	}
+	logger.Info("runDialRetry", "url", url, "dials", dials.Load(), "duration", time.Since(start), "body", string(body))
+}
+
+// runDNSFailure обращается к хосту в зоне .invalid, которая гарантированно не существует
+func runDNSFailure(ctx context.Context) {
+	url := "http://nonexistent.invalid/"
+	client := NewClient(WithTimeout(3 * time.Second))
+	resp, err := client.Get(ctx, url)
+	if err == nil {
+		resp.Body.Close()
+		logger.Error("runDNSFailure", "url", url, "err", "expected dns error, got response")
+		return
+	}
+
+	var dnsErr *net.DNSError
+	logger.Info("runDNSFailure",
+		"url", url,
+		"dns", errors.Is(err, ErrDNSLookup),
+		"not_found", errors.As(err, &dnsErr) && dnsErr.IsNotFound,
+		"err", err)
+}
+
+// runTTFB сравнивает время до первого байта с полным временем: у /slow почти
+// всё уходит на ожидание ответа, у медленного скачивания - на само тело
+func runTTFB(ctx context.Context, serverURL string) {
+	throttled := &http.Client{Transport: &throttledTransport{base: http.DefaultTransport, bytesPerSec: 20 << 10}}
+	cases := []struct {
+		client *http.Client
+		url    string
+	}{
+		{http.DefaultClient, serverURL + "/slow?ms=200"},
+		{throttled, serverURL + "/download?size=10240"},
+	}
+	for _, tc := range cases {
+		res := fetch(ctx, tc.client, tc.url)
+		if res.Err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", tc.url, "err", res.Err)
+			continue
+		}
+		logger.Info("runTTFB",
+			"url", tc.url,
+			"status", res.Status,
+			"ttfb", res.TTFB,
+			"total", res.Duration,
+			"body_time", res.Duration-res.TTFB)
+	}
+}
+
+func runClientDeadline(ctx context.Context, serverURL string) {
+	url := serverURL + "/slow?ms=500"
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	res := fetch(ctx, http.DefaultClient, url)
+	logger.Info("runClientDeadline",
+		"url", url,
+		"duration", res.Duration,
+		"timeout", errors.Is(res.Err, ErrRequestTimeout),
+		"err", res.Err)
+}
+
+func runClockSkew(serverURL string) {
+	url := serverURL + "/time"
+	sent := time.Now()
+	resp, err := http.Get(url)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", url, "duration", time.Since(sent), "err", classifyErr(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	received := time.Now()
+	if err != nil {
+		logger.Error("read failed", "url", url, "err", err)
+		return
+	}
+
+	serverTime, err := time.Parse(time.RFC3339Nano, string(respBody))
+	if err != nil {
+		logger.Error("bad server time", "url", url, "body", string(respBody), "err", err)
+		return
+	}
+
+	// сервер отметил время примерно в середине пути запроса
+	rtt := received.Sub(sent)
+	midpoint := sent.Add(rtt / 2)
+	skew := serverTime.Sub(midpoint)
+	logger.Info("runClockSkew", "url", url, "skew", skew, "rtt", rtt)
+}
+
+func fetchRandom(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, classifyErr(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchRandom: unexpected status %s", resp.Status)
+	}
+	return base64.StdEncoding.DecodeString(string(respBody))
+}
+
+func runRandom(serverURL string) {
+	for _, query := range []string{"?n=16", "?n=16&seed=42", "?n=16&seed=42"} {
+		url := serverURL + "/random" + query
+		data, err := fetchRandom(url)
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", url, "err", err)
+			continue
+		}
+		logger.Info("runRandom", "url", url, "bytes", fmt.Sprintf("%x", data))
+	}
+}
+
+func runTemplate(ctx context.Context, serverURL string) {
+	client := NewClient(WithBaseURL(serverURL))
+	for _, name := range []string{"rvasily", `<script>alert("xss")</script>`} {
+		path := "/template?name=" + neturl.QueryEscape(name)
+		body, err := client.GetBytes(ctx, path)
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", client.url(path), "err", err)
+			continue
+		}
+
+		page := string(body)
+		_, heading, _ := strings.Cut(page, "<h1>")
+		heading, _, _ = strings.Cut(heading, "</h1>")
+		logger.Info("runTemplate",
+			"url", client.url(path),
+			"heading", heading,
+			"escaped", !strings.Contains(page, "<script>"))
+	}
+}
+
+// uuidV4 - каноническая запись в нижнем регистре: версия 4, вариант 8/9/a/b
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func fetchUUID(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", classifyErr(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetchUUID: unexpected status %s", resp.Status)
+	}
+	res := uuidResult{}
+	if err := decodeJSON(resp.Body, &res, clientCfg.StrictJSON); err != nil {
+		return "", err
+	}
+	if !uuidV4.MatchString(res.UUID) {
+		return "", fmt.Errorf("fetchUUID: malformed uuid %q", res.UUID)
+	}
+	return res.UUID, nil
+}
+
+func runUUID(serverURL string) {
+	url := serverURL + "/uuid"
+	seen := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		id, err := fetchUUID(url)
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", url, "err", err)
+			return
+		}
+		if seen[id] {
+			logger.Error("runUUID", "url", url, "err", "duplicate uuid", "uuid", id)
+			return
+		}
+		seen[id] = true
+		logger.Info("runUUID", "url", url, "uuid", id)
+	}
+}
+
+// runChunkedUpload пишет тело через io.Pipe, длина заранее неизвестна,
+// поэтому клиент отправляет его с Transfer-Encoding: chunked
+func runChunkedUpload(serverURL string) {
+	url := serverURL + "/upload"
+	pr, pw := io.Pipe()
+	hash := sha256.New()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			chunk := bytes.Repeat([]byte{byte('a' + i)}, 1024)
+			hash.Write(chunk)
+			if _, err := pw.Write(chunk); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		pw.Close()
+	}()
+
+	start := time.Now()
+	resp, err := http.Post(url, "application/octet-stream", pr)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodPost, "url", url, "duration", time.Since(start), "err", classifyErr(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	res := uploadResult{}
+	err = decodeJSON(resp.Body, &res, clientCfg.StrictJSON)
+	if err != nil {
+		logger.Error("decode failed", "url", url, "err", err)
+		return
+	}
+
+	logger.Info("runChunkedUpload",
+		"url", url,
+		"duration", time.Since(start),
+		"bytes", res.Bytes,
+		"transfer_encoding", res.TransferEncoding,
+		"checksum_ok", res.SHA256 == hex.EncodeToString(hash.Sum(nil)))
+}
+
+// nextLink ищет в заголовках Link ссылку с rel="next", например
+// `</page?n=2>; rel="next", </page?n=1>; rel="prev"`
+func nextLink(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			ref := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(ref, "<") || !strings.HasSuffix(ref, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(key, "rel") {
+					continue
+				}
+				// rel может перечислять несколько типов через пробел
+				if slices.Contains(strings.Fields(strings.Trim(val, `"`)), "next") {
+					return ref[1 : len(ref)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// getAllPages проходит по ссылкам rel="next" и отдаёт тело каждой страницы в collect
+func getAllPages(ctx context.Context, client *http.Client, url string, collect func([]byte)) error {
+	seen := map[string]bool{}
+	for url != "" {
+		if seen[url] {
+			return fmt.Errorf("pagination loop at %s", url)
+		}
+		seen[url] = true
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return classifyErr(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return classifyErr(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+		}
+		collect(body)
+
+		url = ""
+		if next := nextLink(resp.Header); next != "" {
+			// ссылка может быть относительной
+			nextURL, err := resp.Request.URL.Parse(next)
+			if err != nil {
+				return fmt.Errorf("bad next link %q: %w", next, err)
+			}
+			url = nextURL.String()
+		}
+	}
+	return nil
+}
+
+func runPagination(ctx context.Context, serverURL string) {
+	url := serverURL + "/page"
+	pages := 0
+	items := []int{}
+	err := getAllPages(ctx, http.DefaultClient, url, func(body []byte) {
+		p := page{}
+		if err := json.Unmarshal(body, &p); err != nil {
+			logger.Error("bad page", "url", url, "err", err)
+			return
+		}
+		pages++
+		items = append(items, p.Items...)
+	})
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", url, "err", err)
+		return
+	}
+	logger.Info("runPagination", "url", url, "pages", pages, "items", items, "complete", len(items) == pageItems)
+}
+
+// countingReader считает, сколько байт тела транспорт реально забрал
+type countingReader struct {
+	r    io.Reader
+	read atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read.Add(int64(n))
+	return n, err
+}
+
+// runExpectContinue шлёт тело больше и меньше MaxUploadBytes с Expect: 100-continue;
+// отклонённое тело не должно уйти в сеть
+func runExpectContinue(serverURL string) {
+	transport := newPooledTransport()
+	transport.ExpectContinueTimeout = time.Second
+	client := &http.Client{Timeout: 10 * time.Second, Transport: traced(transport)}
+
+	url := serverURL + "/upload"
+	for _, size := range []int64{serverCfg.MaxUploadBytes / 2, 4 * serverCfg.MaxUploadBytes} {
+		body := &countingReader{r: bytes.NewReader(bytes.Repeat([]byte{'x'}, int(size)))}
+		req, _ := http.NewRequest(http.MethodPost, url, body)
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Expect", "100-continue")
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			logger.Error("request failed", "method", req.Method, "url", url, "duration", time.Since(start), "err", classifyErr(err))
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		logger.Info("runExpectContinue",
+			"url", url,
+			"size", size,
+			"status", resp.StatusCode,
+			"body_sent", body.read.Load(),
+			"duration", time.Since(start))
+	}
+}
+
+// runPing делает count последовательных запросов по одному keep-alive соединению:
+// первый платит за установку соединения, остальные показывают "тёплую" задержку
+func runPing(ctx context.Context, c *http.Client, url string, count int) {
+	rtts := make([]time.Duration, 0, count)
+	for i := 0; i < count; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			logger.Error("bad request", "url", url, "err", err)
+			return
+		}
+
+		// time.Since использует монотонные часы
+		start := time.Now()
+		resp, err := c.Do(req)
+		if err != nil {
+			logger.Error("request failed", "method", req.Method, "url", url, "duration", time.Since(start), "err", classifyErr(err))
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		rtts = append(rtts, time.Since(start))
+	}
+	if len(rtts) == 0 {
+		return
+	}
+
+	cold := rtts[0]
+	var total time.Duration
+	for _, rtt := range rtts {
+		total += rtt
+	}
+	slices.Sort(rtts)
+	p99 := rtts[(len(rtts)*99+99)/100-1]
+
+	logger.Info("runPing",
+		"url", url,
+		"count", len(rtts),
+		"cold", cold,
+		"min", rtts[0],
+		"avg", total/time.Duration(len(rtts)),
+		"max", rtts[len(rtts)-1],
+		"p99", p99)
+}
+
+type countingWriter struct {
+	w          io.Writer
+	written    int64
+	total      int64
+	onProgress func(written, total int64)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	if cw.onProgress != nil {
+		cw.onProgress(cw.written, cw.total)
+	}
+	return n, err
+}
+
+// parseContentRange разбирает "bytes 100-199/1000" и "bytes */1000";
+// у второй формы start = -1
+func parseContentRange(header string) (start, size int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	rng, rawSize, ok2 := strings.Cut(spec, "/")
+	if !ok || !ok2 {
+		return 0, 0, fmt.Errorf("bad Content-Range %q", header)
+	}
+	if size, err = strconv.ParseInt(rawSize, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("bad Content-Range %q", header)
+	}
+	if rng == "*" {
+		return -1, size, nil
+	}
+	rawStart, _, _ := strings.Cut(rng, "-")
+	if start, err = strconv.ParseInt(rawStart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("bad Content-Range %q", header)
+	}
+	return start, size, nil
+}
+
+// downloadToFile пишет тело ответа прямо в файл; если файл уже частично
+// скачан, докачивает остаток через Range. total = -1, если размер неизвестен
+func downloadToFile(ctx context.Context, c *http.Client, url, dstPath string, onProgress func(written, total int64)) error {
+	var offset int64
+	if info, err := os.Stat(dstPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return classifyErr(err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if start, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil || start != offset {
+			return fmt.Errorf("downloadToFile: range %q does not continue local file of %d bytes", resp.Header.Get("Content-Range"), offset)
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// сервер не поддержал Range - начинаем заново
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		// файл скачан целиком, только если размеры совпадают: иначе локальный
+		// файл устарел или больше ресурса
+		if _, size, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil || size != offset {
+			return fmt.Errorf("downloadToFile: local file has %d bytes, server reports %q", offset, resp.Header.Get("Content-Range"))
+		}
+		if onProgress != nil {
+			onProgress(offset, offset)
+		}
+		return nil
+	default:
+		return fmt.Errorf("downloadToFile: unexpected status %s", resp.Status)
+	}
+
+	f, err := os.OpenFile(dstPath, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	cw := &countingWriter{w: f, written: offset, total: total, onProgress: onProgress}
+	if _, err := io.Copy(cw, resp.Body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// throttledReader отдаёт не больше bytesPerSec байт в секунду в среднем
+// с момента первого чтения - так выглядит медленный канал для сервера
+type throttledReader struct {
+	ctx         context.Context
+	r           io.ReadCloser
+	bytesPerSec int64
+
+	start time.Time
+	read  int64
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if tr.start.IsZero() {
+		tr.start = time.Now()
+	}
+	// мелкие порции, чтобы скорость была ровной, а не рывками по p
+	if chunk := max(tr.bytesPerSec/10, 1); int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := tr.r.Read(p)
+	tr.read += int64(n)
+
+	due := tr.start.Add(time.Duration(tr.read * int64(time.Second) / tr.bytesPerSec))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-tr.ctx.Done():
+			return n, tr.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+func (tr *throttledReader) Close() error {
+	return tr.r.Close()
+}
+
+// throttledTransport ограничивает скорость чтения тел ответов
+type throttledTransport struct {
+	base        http.RoundTripper
+	bytesPerSec int64
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.bytesPerSec <= 0 {
+		return resp, err
+	}
+	resp.Body = &throttledReader{ctx: req.Context(), r: resp.Body, bytesPerSec: t.bytesPerSec}
+	return resp, nil
+}
+
+// runThrottledDownload качает 20KB на 10KB/s и сравнивает наблюдаемую скорость с заданной
+func runThrottledDownload(ctx context.Context, serverURL string) {
+	const (
+		size = 20 << 10
+		rate = 10 << 10
+	)
+	client := NewClient(
+		WithBaseURL(serverURL),
+		WithTransport(&throttledTransport{base: http.DefaultTransport, bytesPerSec: rate}),
+	)
+	path := fmt.Sprintf("/download?size=%d", size)
+
+	start := time.Now()
+	resp, err := client.Get(ctx, path)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", client.url(path), "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil {
+		logger.Error("download failed", "url", client.url(path), "bytes", n, "err", classifyErr(err))
+		return
+	}
+
+	observed := float64(n) / elapsed.Seconds()
+	logger.Info("runThrottledDownload",
+		"url", client.url(path),
+		"bytes", n,
+		"duration", elapsed,
+		"limit_bps", rate,
+		"observed_bps", int64(observed))
+}
+
+func runDownload(ctx context.Context, serverURL string) {
+	const size = 256 << 10
+	url := fmt.Sprintf("%s/download?size=%d", serverURL, size)
+
+	dir, err := os.MkdirTemp("", "download")
+	if err != nil {
+		logger.Error("temp dir failed", "err", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	dstPath := filepath.Join(dir, "download.bin")
+
+	updates := 0
+	progress := func(written, total int64) { updates++ }
+
+	// скачиваем, обрезаем файл и докачиваем остаток
+	for _, keep := range []int64{-1, size / 3} {
+		if keep >= 0 {
+			os.Truncate(dstPath, keep)
+		}
+
+		updates = 0
+		start := time.Now()
+		err := downloadToFile(ctx, http.DefaultClient, url, dstPath, progress)
+		if err != nil {
+			logger.Error("download failed", "method", http.MethodGet, "url", url, "duration", time.Since(start), "err", err)
+			return
+		}
+
+		got, err := os.ReadFile(dstPath)
+		if err != nil {
+			logger.Error("read failed", "path", dstPath, "err", err)
+			return
+		}
+		logger.Info("runDownload",
+			"url", url,
+			"resumed_from", max(keep, 0),
+			"progress_updates", updates,
+			"duration", time.Since(start),
+			"match", bytes.Equal(got, downloadData(size)))
+	}
+}
+
+func runValidateJSON(serverURL string) {
+	url := serverURL + "/validate-json"
+	payloads := []string{
+		`{"id": 42, "user": "rvasily"}`,
+		`{"id": 42, "user": }`,
+		`{"id": 42`,
+		`{"id": 42} {}`,
+	}
+
+	for _, payload := range payloads {
+		resp, err := http.Post(url, "application/json", bytes.NewBufferString(payload))
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodPost, "url", url, "err", classifyErr(err))
+			return
+		}
+
+		res := validationResult{}
+		err = decodeJSON(resp.Body, &res, clientCfg.StrictJSON)
+		resp.Body.Close()
+		if err != nil {
+			logger.Error("decode failed", "url", url, "err", err)
+			return
+		}
+
+		attrs := []interface{}{"payload", payload, "valid", res.Valid}
+		if res.Offset != nil {
+			attrs = append(attrs, "offset", *res.Offset, "message", res.Message)
+		}
+		logger.Info("runValidateJSON", attrs...)
+	}
+}
+
+func runCoalescing(serverURL string) {
+	url := serverURL + "/expensive?q=thundering-herd"
+	results := make([]expensiveResult, 10)
+
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				logger.Error("request failed", "method", http.MethodGet, "url", url, "err", classifyErr(err))
+				return
+			}
+			defer resp.Body.Close()
+			decodeJSON(resp.Body, &results[i], clientCfg.StrictJSON)
+		}()
+	}
+	wg.Wait()
+
+	shared := 0
+	var computations int64
+	for _, res := range results {
+		if res.Shared {
+			shared++
+		}
+		computations = max(computations, res.Computations)
+	}
+	logger.Info("runCoalescing",
+		"url", url,
+		"requests", len(results),
+		"shared", shared,
+		"computations", computations,
+		"duration", time.Since(start))
+}
+
+func doCount(method, url string) (countResult, error) {
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return countResult{}, classifyErr(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return countResult{}, fmt.Errorf("doCount: unexpected status %s", resp.Status)
+	}
+	res := countResult{}
+	err = decodeJSON(resp.Body, &res, clientCfg.StrictJSON)
+	return res, err
+}
+
+func incrementCount(url string) (int64, error) {
+	res, err := doCount(http.MethodGet, url)
+	return res.Count, err
+}
+
+func resetCount(url string) (int64, error) {
+	res, err := doCount(http.MethodDelete, url)
+	return res.Previous, err
+}
+
+var errKeyNotFound = errors.New("key not found")
+
+func kvDo(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, classifyErr(err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errKeyNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: unexpected status %s", method, url, resp.Status)
+	}
+	return resp, nil
+}
+
+func kvSet(ctx context.Context, serverURL, key string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	resp, err := kvDo(ctx, http.MethodPut, serverURL+"/kv/"+neturl.PathEscape(key), body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// kvGet возвращает errKeyNotFound, если ключа нет
+func kvGet(ctx context.Context, serverURL, key string, dst interface{}) error {
+	resp, err := kvDo(ctx, http.MethodGet, serverURL+"/kv/"+neturl.PathEscape(key), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeJSON(resp.Body, dst, false)
+}
+
+func kvDelete(ctx context.Context, serverURL, key string) error {
+	resp, err := kvDo(ctx, http.MethodDelete, serverURL+"/kv/"+neturl.PathEscape(key), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// runAggregate запрашивает /aggregate дважды: обычный и с подзапросом,
+// который не укладывается в AggregateTimeout
+func runAggregate(ctx context.Context, serverURL string) {
+	client := NewClient(WithBaseURL(serverURL))
+	slowMS := 2 * serverCfg.AggregateTimeout.Milliseconds()
+	for _, path := range []string{"/aggregate", fmt.Sprintf("/aggregate?slow=%d", slowMS)} {
+		body, err := client.GetBytes(ctx, path)
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", client.url(path), "err", err)
+			continue
+		}
+		res := aggregateResult{}
+		if err := json.Unmarshal(body, &res); err != nil {
+			logger.Error("decode failed", "url", client.url(path), "err", err)
+			continue
+		}
+
+		statuses := map[string]string{}
+		for name, sub := range res.Results {
+			statuses[name] = sub.Status
+			if sub.Error != "" {
+				statuses[name] += ": " + sub.Error
+			}
+		}
+		logger.Info("runAggregate", "url", client.url(path), "ok", res.OK, "results", statuses)
+	}
+}
+
+func runCount(serverURL string) {
+	url := serverURL + "/count"
+	for i := 0; i < 3; i++ {
+		if _, err := incrementCount(url); err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", url, "err", err)
+			return
+		}
+	}
+
+	previous, err := resetCount(url)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodDelete, "url", url, "err", err)
+		return
+	}
+	// после сброса счёт начинается с единицы
+	next, err := incrementCount(url)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", url, "err", err)
+		return
+	}
+	logger.Info("runCount", "url", url, "before_reset", previous, "after_reset", next)
+}
+
+func runEnv(serverURL string) {
+	url := serverURL + "/env"
+	resp, err := http.Get(url)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", url, "err", classifyErr(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	res := envResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		logger.Error("bad response", "url", url, "err", err)
+		return
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range serverCfg.EnvAllowlist {
+		allowed[name] = true
+	}
+	for name := range res.Vars {
+		if !allowed[name] {
+			logger.Error("env leaked", "url", url, "name", name)
+		}
+	}
+	logger.Info("runEnv", "url", url, "vars", res.Vars, "absent", res.Absent)
+}
+
+// runSlowloris шлёт заголовки по байту раз в 100мс и замеряет,
+// через сколько сервер закроет соединение
+func runSlowloris(serverURL string) {
+	addr := strings.TrimPrefix(serverURL, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		logger.Error("dial failed", "addr", addr, "err", err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	go func() {
+		request := "GET /slowloris-guard HTTP/1.1\r\nHost: " + addr + "\r\nX-Padding: "
+		for i := 0; ; i++ {
+			b := []byte{'x'}
+			if i < len(request) {
+				b[0] = request[i]
+			}
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	// ждём, пока сервер закроет соединение, и смотрим, что он успел ответить
+	conn.SetReadDeadline(time.Now().Add(3 * serverCfg.ReadHeaderTimeout))
+	reply, err := ioutil.ReadAll(conn)
+	statusLine, _, _ := strings.Cut(string(reply), "\r\n")
+	logger.Info("runSlowloris",
+		"addr", addr,
+		"closed_after", time.Since(start),
+		"read_header_timeout", serverCfg.ReadHeaderTimeout,
+		"reply", statusLine,
+		"err", err)
+}
+
+func whoami(req *http.Request) (int, string, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", classifyErr(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, "", nil
+	}
+	res := map[string]string{}
+	err = decodeJSON(resp.Body, &res, clientCfg.StrictJSON)
+	return resp.StatusCode, res["principal"], err
+}
+
+func setMaintenance(ctx context.Context, serverURL string, enabled bool) error {
+	body, _ := json.Marshal(maintenanceState{Enabled: enabled})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, serverURL+maintenancePath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("rvasily", demoUsers["rvasily"])
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "getHandler: incoming request\n")
-		fmt.Fprintf(w, "getHandler: r.Url %#v\n", r.URL)
-	})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return classifyErr(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: unexpected status %s", maintenancePath, resp.Status)
+	}
+	return nil
+}
 
-	mux.HandleFunc("/raw_body", func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
-		defer r.Body.Close()
+// runMaintenance включает обслуживание и проверяет, что обычный маршрут
+// отвечает 503, а /healthz - по-прежнему 200
+func runMaintenance(ctx context.Context, serverURL string) {
+	if err := setMaintenance(ctx, serverURL, true); err != nil {
+		logger.Error("enable maintenance failed", "err", err)
+		return
+	}
+	// выключаем в любом случае, иначе остальные демо получат 503
+	defer func() {
+		if err := setMaintenance(ctx, serverURL, false); err != nil {
+			logger.Error("disable maintenance failed", "err", err)
+		}
+	}()
+
+	for _, path := range []string{"/ping", "/healthz"} {
+		resp, err := http.Get(serverURL + path)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			logger.Error("request failed", "method", http.MethodGet, "url", serverURL+path, "err", classifyErr(err))
 			return
 		}
-		fmt.Fprintf(w, "postHandler: raw body %s\n", string(body))
-	})
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		logger.Info("runMaintenance", "url", serverURL+path, "status", resp.StatusCode, "body", strings.TrimSpace(string(body)))
+	}
+}
 
-	server := &http.Server{Handler: mux}
-	listener, _ := net.Listen("tcp", ":0")
-	addr <- listener.Addr().String()
+func runBasicAuth(serverURL string) {
+	url := serverURL + "/whoami"
+	for _, pass := range []string{"secret", "wrong"} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.SetBasicAuth("rvasily", pass)
 
-	server.Serve(listener)
+		status, principal, err := whoami(req)
+		if err != nil {
+			logger.Error("request failed", "method", req.Method, "url", url, "err", err)
+			return
+		}
+		logger.Info("runBasicAuth", "url", url, "password", pass, "status", status, "principal", principal)
+	}
 }
 
-func runGet(serverURL string) {
-	url := serverURL + "/?param=123&param2=test"
-	resp, err := http.Get(url)
+func runBearerAuth(serverURL string) {
+	url := serverURL + "/whoami"
+	jwt, err := signJWT(jwtClaims{Sub: "rvasily", Exp: time.Now().Add(time.Minute).Unix()}, serverCfg.JWTSecret)
+	if err != nil {
+		logger.Error("sign failed", "err", err)
+		return
+	}
+	forged, _ := signJWT(jwtClaims{Sub: "admin"}, []byte("not-the-secret"))
+
+	for _, token := range []string{"demo-token", jwt, "wrong-token", forged} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		status, principal, err := whoami(req)
+		if err != nil {
+			logger.Error("request failed", "method", req.Method, "url", url, "err", err)
+			return
+		}
+		logger.Info("runBearerAuth", "url", url, "jwt", strings.Count(token, ".") == 2, "status", status, "principal", principal)
+	}
+}
+
+// runOverload шлёт больше одновременных запросов, чем сервер готов принять:
+// часть проходит сразу, часть после очереди, остальные получают 503
+func runOverload(ctx context.Context, serverURL string) {
+	url := serverURL + "/slow?ms=100"
+	total := serverCfg.MaxInFlight + 2*serverCfg.QueueSize
+
+	statuses := make([]int, total)
+	wg := &sync.WaitGroup{}
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				logger.Error("request failed", "method", http.MethodGet, "url", url, "err", classifyErr(err))
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}()
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+
+	metrics := fetch(ctx, http.DefaultClient, serverURL+"/metrics")
+	logger.Info("runOverload",
+		"url", url,
+		"requests", total,
+		"ok", counts[http.StatusOK],
+		"rejected", counts[http.StatusServiceUnavailable],
+		"metrics", strings.TrimSpace(string(metrics.Body)))
+}
+
+func runDiff(serverURL string) {
+	url := serverURL + "/diff"
+	data := `{
+		"a": {"id": 42, "user": "rvasily", "address": {"city": "Moscow", "zip": "101000"}, "tags": ["go"]},
+		"b": {"id": "42", "user": "rvasily", "address": {"city": "Kazan"}, "tags": ["go", "http"], "active": true}
+	}`
+
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(data))
 	if err != nil {
-		fmt.Println("error happend", err)
+		logger.Error("request failed", "method", http.MethodPost, "url", url, "err", classifyErr(err))
 		return
 	}
 	defer resp.Body.Close()
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	fmt.Printf("http.Get body %#v\n\n\n", string(respBody))
+	res := DiffResult{}
+	if err := decodeJSON(resp.Body, &res, clientCfg.StrictJSON); err != nil {
+		logger.Error("decode failed", "url", url, "err", err)
+		return
+	}
+	logger.Info("runDiff", "url", url, "added", res.Added, "removed", res.Removed, "changed", res.Changed)
+}
+
+func runFieldSelection(ctx context.Context, serverURL string) {
+	client := NewClient(WithBaseURL(serverURL))
+	for _, fields := range [][]string{{"id", "email"}, {"id", "password", "role"}} {
+		resp, err := client.PostJSON(ctx, "/graphql-lite", selectionRequest{Fields: fields})
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodPost, "url", client.url("/graphql-lite"), "err", err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			logger.Error("read failed", "url", client.url("/graphql-lite"), "err", classifyErr(err))
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			res := selectionError{}
+			json.Unmarshal(body, &res)
+			logger.Info("runFieldSelection", "fields", fields, "status", resp.StatusCode, "unknown", res.Unknown)
+			continue
+		}
+
+		res := map[string]interface{}{}
+		if err := json.Unmarshal(body, &res); err != nil {
+			logger.Error("decode failed", "url", client.url("/graphql-lite"), "err", err)
+			return
+		}
+		exact := len(res) == len(fields)
+		for _, name := range fields {
+			_, ok := res[name]
+			exact = exact && ok
+		}
+		logger.Info("runFieldSelection", "fields", fields, "status", resp.StatusCode, "result", res, "exact", exact)
+	}
 }
 
-func runGetFullReq(serverURL string) {
-	fullURL := serverURL + "/?id=42&user=rvasily"
+// runSleepThenStream проверяет оба пути /sleep-then-stream: заголовки не
+// успевают за ResponseHeaderTimeout, и отмена контекста после первого куска
+func runSleepThenStream(ctx context.Context, serverURL string) {
+	transport := newPooledTransport()
+	transport.ResponseHeaderTimeout = 100 * time.Millisecond
+	client := &http.Client{Transport: traced(transport)}
 
-	req, _ := http.NewRequest(http.MethodGet, fullURL, nil)
-	req.Header.Set("User-Agent", "coursera/golang")
+	url := serverURL + "/sleep-then-stream?delay=300&chunks=3&interval=10"
+	start := time.Now()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		logger.Error("runSleepThenStream", "url", url, "err", "expected header timeout, got response")
+	} else {
+		err = classifyErr(err)
+		logger.Info("runSleepThenStream",
+			"case", "header timeout",
+			"url", url,
+			"duration", time.Since(start),
+			"timeout", errors.Is(err, ErrRequestTimeout),
+			"err", err)
+	}
+
+	// заголовки приходят через 50мс - в пределах ResponseHeaderTimeout
+	url = serverURL + "/sleep-then-stream?delay=50&chunks=20&interval=50"
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start = time.Now()
+	req, _ = http.NewRequestWithContext(streamCtx, http.MethodGet, url, nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		logger.Error("request failed", "method", req.Method, "url", url, "err", classifyErr(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	first, err := reader.ReadString('\n')
+	if err != nil {
+		logger.Error("read failed", "url", url, "err", classifyErr(err))
+		return
+	}
+	ttfc := time.Since(start)
+	cancel()
+
+	rest, err := ioutil.ReadAll(reader)
+	logger.Info("runSleepThenStream",
+		"case", "cancel mid-stream",
+		"url", url,
+		"first_chunk", strings.TrimSpace(first),
+		"first_chunk_after", ttfc,
+		"bytes_after_cancel", len(rest),
+		"canceled", errors.Is(err, context.Canceled),
+		"err", err)
+	// даём серверу заметить отмену, чтобы его лог шёл рядом с клиентским
+	time.Sleep(50 * time.Millisecond)
+}
+
+// runStats шлёт на /slow запросы с задержками 10..100мс и печатает перцентили
+func runStats(ctx context.Context, serverURL string) {
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(ms int) {
+			defer wg.Done()
+			resp, err := http.Get(fmt.Sprintf("%s/slow?ms=%d", serverURL, ms))
+			if err != nil {
+				logger.Error("request failed", "method", http.MethodGet, "url", serverURL+"/slow", "err", classifyErr(err))
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}(i * 10)
+	}
+	wg.Wait()
+
+	url := serverURL + "/stats"
+	resp, err := NewClient().Get(ctx, url)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", url, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	res := struct {
+		Routes map[string]routeStats `json:"routes"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		logger.Error("bad response", "url", url, "err", err)
+		return
+	}
+	slow := res.Routes["/slow"]
+	logger.Info("runStats",
+		"url", url,
+		"route", "/slow",
+		"count", slow.Count,
+		"p50_ms", slow.P50,
+		"p90_ms", slow.P90,
+		"p99_ms", slow.P99)
+}
 
+// runShutdownStatus запускает долгий запрос, подписывается на /shutdown-status
+// и останавливает сервер; активных соединений должно становиться меньше до нуля
+func runShutdownStatus(ctx context.Context, serverURL string, stop func()) {
+	slowURL := serverURL + "/slow?ms=600"
+	slowDone := make(chan int, 1)
+	go func() {
+		resp, err := newPooledClient().Get(slowURL)
+		if err != nil {
+			logger.Error("request failed", "method", http.MethodGet, "url", slowURL, "err", classifyErr(err))
+			slowDone <- 0
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		slowDone <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	url := serverURL + "/shutdown-status"
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		fmt.Println("error happend", err)
+		logger.Error("request failed", "method", req.Method, "url", url, "err", classifyErr(err))
 		return
 	}
 	defer resp.Body.Close()
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	fmt.Printf("testGetFullReq resp %#v\n\n\n", string(respBody))
+	event := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+
+		ev := drainEvent{}
+		json.Unmarshal([]byte(data), &ev)
+		logger.Info("runShutdownStatus", "event", event, "active", ev.Active, "elapsed_ms", ev.ElapsedMS, "drained", ev.Drained)
+		switch event {
+		case "waiting":
+			stop()
+		case "done":
+			logger.Info("runShutdownStatus", "slow_status", <-slowDone)
+			return
+		}
+	}
+	logger.Error("runShutdownStatus", "url", url, "err", "stream ended without done event", "scan_err", scanner.Err())
 }
 
-func runTransportAndPost(serverURL string) {
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns: 100,
+type connTrace struct {
+	dials  int
+	reused bool
+}
+
+func (ct *connTrace) wrap(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) { ct.dials++ },
+		GotConn:      func(info httptrace.GotConnInfo) { ct.reused = info.Reused },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func runConnectionClose(serverURL string) {
+	client := newPooledClient()
+	steps := []struct {
+		path  string
+		close bool
+	}{
+		{"/", false},
+		{"/", false},
+		{"/", true}, // клиент сам просит Connection: close
+		{"/", false},
+		{"/close", false}, // сервер закрывает соединение
+		{"/", false},
 	}
 
-	client := &http.Client{
-		Timeout:   time.Second * 10,
-		Transport: transport,
+	ct := &connTrace{}
+	for _, step := range steps {
+		req, _ := http.NewRequest(http.MethodGet, serverURL+step.path, nil)
+		req.Close = step.close
+		req = ct.wrap(req)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger.Error("request failed", "method", req.Method, "url", req.URL.String(), "err", classifyErr(err))
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		logger.Info("runConnectionClose",
+			"path", step.path,
+			"close", step.close,
+			"reused", ct.reused,
+			"dials", ct.dials,
+			"resp_close", resp.Close)
+	}
+}
+
+// runConnRotation поднимает отдельный сервер с лимитом запросов на соединение
+// (у основного он по умолчанию выключен, чтобы не мешать keep-alive демо) и
+// проверяет, что клиенту приходится переподключаться после limit запросов
+func runConnRotation() {
+	const limit = 5
+	conns := newConnLimiter(limit, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logger.Error("listen failed", "err", err)
+		return
+	}
+	server := &http.Server{
+		Handler: conns.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "pong")
+		})),
+		ConnContext: conns.connContext,
+		ConnState:   conns.connState,
+	}
+	go server.Serve(ln)
+	defer server.Close()
+	serverURL := "http://" + ln.Addr().String()
+
+	client := newPooledClient()
+	ct := &connTrace{}
+	served := 0
+	for i := 1; i <= 2*limit+1; i++ {
+		req, _ := http.NewRequest(http.MethodGet, serverURL+"/ping", nil)
+		req = ct.wrap(req)
+		dials := ct.dials
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger.Error("request failed", "method", req.Method, "url", req.URL.String(), "err", classifyErr(err))
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if ct.dials != dials && i > 1 {
+			logger.Info("runConnRotation", "request", i, "redial_after", served, "limit", limit, "ok", served == limit)
+			served = 0
+		}
+		served++
+	}
+	logger.Info("runConnRotation", "requests", 2*limit+1, "dials", ct.dials)
+}
+
+func newCookieClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar, Transport: traced(http.DefaultTransport)}
+}
+
+// setCSRFToken копирует CSRF-токен из cookie-jar клиента в заголовок
+func setCSRFToken(c *http.Client, req *http.Request) {
+	if c.Jar == nil {
+		return
+	}
+	for _, cookie := range c.Jar.Cookies(req.URL) {
+		if cookie.Name == csrfCookieName {
+			req.Header.Set(csrfHeaderName, cookie.Value)
+		}
+	}
+}
+
+func getUser(c *http.Client, userURL string) (User, string, error) {
+	resp, err := c.Get(userURL)
+	if err != nil {
+		return User{}, "", classifyErr(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return User{}, "", fmt.Errorf("getUser: unexpected status %s", resp.Status)
 	}
 
-	data := `{"id": 42, "user": "rvasily"}`
-	body := bytes.NewBufferString(data)
+	user := User{}
+	err = decodeJSON(resp.Body, &user, clientCfg.StrictJSON)
+	return user, resp.Header.Get("ETag"), err
+}
+
+func putUser(c *http.Client, userURL string, user User, etag string) (string, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return "", err
+	}
 
-	url := serverURL + "/raw_body"
-	req, _ := http.NewRequest(http.MethodPost, url, body)
+	req, _ := http.NewRequest(http.MethodPut, userURL, bytes.NewReader(data))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", etag)
+	setCSRFToken(c, req)
 
-	resp, err := client.Do(req)
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", classifyErr(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed:
+		return "", errPreconditionFailed
+	default:
+		return "", fmt.Errorf("putUser: unexpected status %s", resp.Status)
+	}
+}
+
+// updateUser читает пользователя, меняет его и записывает обратно с If-Match
+func updateUser(c *http.Client, userURL string, modify func(*User)) error {
+	user, etag, err := getUser(c, userURL)
+	if err != nil {
+		return err
+	}
+	modify(&user)
+	_, err = putUser(c, userURL, user, etag)
+	return err
+}
+
+func runConditionalPut(serverURL string) {
+	userURL := serverURL + "/users/42"
+	firstClient, secondClient := newCookieClient(), newCookieClient()
+
+	// оба клиента прочитали одну и ту же версию
+	first, firstETag, err := getUser(firstClient, userURL)
+	if err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", userURL, "err", err)
+		return
+	}
+	second, secondETag, err := getUser(secondClient, userURL)
 	if err != nil {
-		fmt.Println("error happend", err)
+		logger.Error("request failed", "method", http.MethodGet, "url", userURL, "err", err)
+		return
+	}
+
+	first.User = "first"
+	_, err = putUser(firstClient, userURL, first, firstETag)
+	logger.Info("runConditionalPut first write", "url", userURL, "etag", firstETag, "err", err)
+
+	second.User = "second"
+	_, err = putUser(secondClient, userURL, second, secondETag)
+	logger.Info("runConditionalPut second write", "url", userURL, "etag", secondETag, "err", err)
+
+	err = updateUser(secondClient, userURL, func(u *User) { u.User = "rvasily" })
+	logger.Info("runConditionalPut retry with fresh ETag", "url", userURL, "err", err)
+}
+
+func runCSRF(serverURL string) {
+	userURL := serverURL + "/users/42"
+	c := newCookieClient()
+
+	// GET выдаёт токен в cookie
+	if _, _, err := getUser(c, userURL); err != nil {
+		logger.Error("request failed", "method", http.MethodGet, "url", userURL, "err", err)
 		return
 	}
+
+	for _, token := range []string{"", "forged", "from-cookie"} {
+		req, _ := http.NewRequest(http.MethodPatch, userURL, bytes.NewBufferString(`{"user": "rvasily"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if token == "from-cookie" {
+			setCSRFToken(c, req)
+		} else if token != "" {
+			req.Header.Set(csrfHeaderName, token)
+		}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			logger.Error("request failed", "method", req.Method, "url", userURL, "err", classifyErr(err))
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		logger.Info("runCSRF", "url", userURL, "token", token, "status", resp.StatusCode)
+	}
+}
+
+type Result struct {
+	URL    string
+	Status int
+	Body   []byte
+	Err    error
+	// TTFB - до первого байта ответа, Duration - до конца тела
+	TTFB     time.Duration
+	Duration time.Duration
+}
+
+func fetch(ctx context.Context, c *http.Client, url string) (res Result) {
+	res.URL = url
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { res.TTFB = time.Since(start) },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, url, nil)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		res.Err = classifyErr(err)
+		return res
+	}
 	defer resp.Body.Close()
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	fmt.Printf("runTransport %#v\n\n\n", string(respBody))
+	res.Status = resp.StatusCode
+	res.Body, res.Err = ioutil.ReadAll(resp.Body)
+	res.Err = classifyErr(res.Err)
+	return res
 }
 
-func main() {
+func runBatch(ctx context.Context, c *http.Client, urls []string) []Result {
+	workers := clientCfg.BatchConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+
+	results := make([]Result, len(urls))
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx] = fetch(ctx, c, urls[idx])
+			}
+		}()
+	}
+
+	for idx := range urls {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+type command struct {
+	name       string
+	addr       string
+	serverURL  string
+	forceHTTP1 bool
+	strictJSON bool
+	tracePath  string
+}
+
+// parseCommand разбирает подкоманды:
+//
+//	demo [-http1] [-strict] [-trace f] - поднять сервер и прогнать по нему клиентов (по умолчанию)
+//	serve [-addr :8080]                - только сервер, работает до сигнала
+//	client [-strict] [-trace f] <url>  - только клиенты против внешнего сервера
+//
+// -strict включает clientCfg.StrictJSON: лишние поля в ответах - ошибка
+func parseCommand(args []string) (command, error) {
+	if len(args) == 0 {
+		return command{name: "demo"}, nil
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "demo":
+		forceHTTP1 := fs.Bool("http1", false, "force HTTP/1.1 for TLS requests")
+		strictJSON := fs.Bool("strict", false, "reject unknown fields in JSON responses")
+		tracePath := fs.String("trace", "", "write a chrome://tracing JSON file at exit")
+		if err := fs.Parse(args[1:]); err != nil {
+			return command{}, err
+		}
+		return command{name: "demo", forceHTTP1: *forceHTTP1, strictJSON: *strictJSON, tracePath: *tracePath}, nil
+
+	case "serve":
+		addr := fs.String("addr", ":8080", "listen address")
+		if err := fs.Parse(args[1:]); err != nil {
+			return command{}, err
+		}
+		return command{name: "serve", addr: *addr}, nil
+
+	case "client":
+		strictJSON := fs.Bool("strict", false, "reject unknown fields in JSON responses")
+		tracePath := fs.String("trace", "", "write a chrome://tracing JSON file at exit")
+		if err := fs.Parse(args[1:]); err != nil {
+			return command{}, err
+		}
+		if fs.NArg() != 1 {
+			return command{}, fmt.Errorf("client: expected exactly one server URL, got %d args", fs.NArg())
+		}
+		return command{name: "client", serverURL: strings.TrimSuffix(fs.Arg(0), "/"), strictJSON: *strictJSON, tracePath: *tracePath}, nil
+
+	default:
+		return command{}, fmt.Errorf("unknown command %q, expected demo, serve or client", args[0])
+	}
+}
+
+func runClients(ctx context.Context, serverURL string) {
+	// первым, пока на /slow не пришли запросы других демо
+	runStats(ctx, serverURL)
+	runGet(ctx, serverURL)
+	runGetFullReq(ctx, serverURL)
+	runTransportAndPost(ctx, serverURL)
+	runRecordReplay(ctx, serverURL)
+	runJSON(serverURL)
+	runTamperedJSON(serverURL)
+	runSlow(serverURL)
+	runClientDeadline(ctx, serverURL)
+	runTTFB(ctx, serverURL)
+	runSleepThenStream(ctx, serverURL)
+	runDNSFailure(ctx)
+	runConnectionReset(ctx, serverURL)
+	runDialRetry(ctx)
+	runClockSkew(serverURL)
+	runRandom(serverURL)
+	runUUID(serverURL)
+	runTemplate(ctx, serverURL)
+	runChunkedUpload(serverURL)
+	runExpectContinue(serverURL)
+	runDownload(ctx, serverURL)
+	runThrottledDownload(ctx, serverURL)
+	runPagination(ctx, serverURL)
+	runValidateJSON(serverURL)
+	runDiff(serverURL)
+	runFieldSelection(ctx, serverURL)
+	runCoalescing(serverURL)
+	runOverload(ctx, serverURL)
+	runCount(serverURL)
+	runAggregate(ctx, serverURL)
+	runEnv(serverURL)
+	runBasicAuth(serverURL)
+	runBearerAuth(serverURL)
+	runPing(ctx, newPooledClient(), serverURL+"/ping", 50)
+	runConnectionClose(serverURL)
+	runConnRotation()
+	runSlowloris(serverURL)
+	runConditionalPut(serverURL)
+	runCSRF(serverURL)
+	runMaintenance(ctx, serverURL)
+
+	results := runBatch(ctx, http.DefaultClient, []string{
+		serverURL + "/?param=123&param2=test",
+		serverURL + "/?id=42&user=rvasily",
+		serverURL + "/slow?ms=100",
+		serverURL + "/?param=abc&id=1.5",
+		"http://127.0.0.1:1/unreachable",
+		"http://nonexistent.invalid/",
+	})
+	for _, res := range results {
+		if res.Err != nil {
+			logger.Error("runBatch", "url", res.URL, "duration", res.Duration, "err", res.Err)
+			continue
+		}
+		logger.Info("runBatch", "url", res.URL, "status", res.Status, "bytes", len(res.Body), "ttfb", res.TTFB, "duration", res.Duration)
+	}
+}
+
+// waitAddr ждёт адрес от сервера. ok=false, если сервер завершился раньше,
+// чем начал слушать (done закрыт), или отменили ctx
+func waitAddr(ctx context.Context, addr <-chan string, done <-chan struct{}) (string, bool) {
+	select {
+	case a := <-addr:
+		return a, true
+	case <-done:
+		return "", false
+	case <-ctx.Done():
+		return "", false
+	}
+}
+
+func runDemo(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// основной сервер останавливаем отдельно - в конце демо смотрим на его drain
+	serverCtx, stopServer := context.WithCancel(ctx)
+	defer stopServer()
+
 	addr := make(chan string)
-	go startServer(addr)
+	serverDone := make(chan struct{})
+	go func() {
+		startServer(serverCtx, addr)
+		close(serverDone)
+	}()
+
+	a, ok := waitAddr(ctx, addr, serverDone)
+	if !ok {
+		logger.Error("server did not start")
+		return
+	}
+	serverURL := "http://" + a
+	logger.Info("server started", "url", serverURL)
+
+	runClients(ctx, serverURL)
+
+	cert, roots, err := selfSignedCert()
+	if err != nil {
+		logger.Error("certificate failed", "err", err)
+		return
+	}
+	tlsAddr := make(chan string)
+	tlsDone := make(chan struct{})
+	go func() {
+		startTLSServer(ctx, cert, tlsAddr)
+		close(tlsDone)
+	}()
+	if a, ok := waitAddr(ctx, tlsAddr, tlsDone); ok {
+		runProtocols("https://"+a, roots)
+	} else {
+		logger.Error("tls server did not start")
+	}
+
+	runShutdownStatus(ctx, serverURL, stopServer)
+	<-serverDone
+}
+
+func main() {
+	logger = newLogger(os.Getenv("LOG_FORMAT"))
+
+	cmd, err := parseCommand(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		logger.Error("bad arguments", "err", err)
+		os.Exit(2)
+	}
 
-	serverURL := "http://" + <-addr
-	fmt.Println("Server started at:", serverURL)
+	cfg, err := loadReloadableConfig()
+	if err != nil {
+		logger.Error("bad config", "err", err)
+		os.Exit(1)
+	}
+	applyConfig(cfg)
+
+	serverCfg.Chaos, err = loadChaosConfig()
+	if err != nil {
+		logger.Error("bad config", "err", err)
+		os.Exit(1)
+	}
+
+	if raw := os.Getenv("AUTH_SCHEMES"); raw != "" {
+		serverCfg.AuthSchemes = strings.Split(raw, ",")
+	}
+	maintenance.Store(os.Getenv("MAINTENANCE") == "1")
+	if raw := os.Getenv("KV_PATH"); raw != "" {
+		serverCfg.KVPath = raw
+	}
+	if raw, ok := os.LookupEnv("ENV_ALLOWLIST"); ok {
+		serverCfg.EnvAllowlist = strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	clientCfg.ForceHTTP1 = cmd.forceHTTP1
+	clientCfg.StrictJSON = cmd.strictJSON
+	if cmd.tracePath != "" {
+		tracer = newSpanCollector()
+		http.DefaultClient.Transport = traced(http.DefaultTransport)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go watchConfigReload(ctx)
+
+	switch cmd.name {
+	case "serve":
+		serverCfg.Addr = cmd.addr
+		startServer(ctx, make(chan string, 1))
+	case "client":
+		runClients(ctx, cmd.serverURL)
+	default:
+		runDemo(ctx)
+	}
 
-	runGet(serverURL)
-	runGetFullReq(serverURL)
-	runTransportAndPost(serverURL)
+	if tracer != nil {
+		if err := tracer.writeChromeTrace(cmd.tracePath); err != nil {
+			logger.Error("trace export failed", "path", cmd.tracePath, "err", err)
+			return
+		}
+		logger.Info("trace written", "path", cmd.tracePath)
+	}
 }
@@ -0,0 +1,2431 @@
+package main
+
+// requests.go лежит в одном каталоге с другими main-программами, поэтому
+// тесты запускаются списком файлов, а не пакетом:
+//
+//	go test requests.go requests_test.go
+//
+// Фаззинг так же:
+//
+//	go test -fuzz FuzzJSONHandler requests.go requests_test.go
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withServerConfig меняет serverCfg на время теста
+func withServerConfig(t *testing.T, change func(cfg *serverConfig)) {
+	t.Helper()
+	old := serverCfg
+	change(&serverCfg)
+	t.Cleanup(func() { serverCfg = old })
+}
+
+func TestStartServerCancelBeforeAddr(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = "127.0.0.1:0"
+		cfg.KVPath = filepath.Join(t.TempDir(), "kv.json")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		// адрес никто не читает
+		startServer(ctx, make(chan string))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("startServer did not return after ctx was cancelled")
+	}
+}
+
+func TestDecodeJSONExtraField(t *testing.T) {
+	body := `{"id": 42, "user": "rvasily", "role": "admin"}`
+
+	lenient := User{}
+	if err := decodeJSON(strings.NewReader(body), &lenient, false); err != nil {
+		t.Fatalf("lenient decode: unexpected error %v", err)
+	}
+	if lenient != (User{ID: 42, User: "rvasily"}) {
+		t.Errorf("lenient decode = %+v", lenient)
+	}
+
+	strict := User{}
+	err := decodeJSON(strings.NewReader(body), &strict, true)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "role"`) {
+		t.Errorf("strict decode: want unknown field error, got %v", err)
+	}
+}
+
+func TestLimitListenerDelaysExtraConn(t *testing.T) {
+	const n = 2
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	srv.Listener = newLimitListener(ln, n)
+	srv.Start()
+	defer srv.Close()
+
+	// у каждого транспорта своё keep-alive соединение, которое держит слот
+	get := func(tr *http.Transport) error {
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.Body.Close()
+	}
+	transports := make([]*http.Transport, n+1)
+	for i := range transports {
+		transports[i] = &http.Transport{}
+		defer transports[i].CloseIdleConnections()
+	}
+	for _, tr := range transports[:n] {
+		if err := get(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- get(transports[n]) }()
+	select {
+	case err := <-done:
+		t.Fatalf("connection %d was served while %d are open (err %v)", n+1, n, err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	transports[0].CloseIdleConnections()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("connection %d was not served after a slot was released", n+1)
+	}
+}
+
+func TestRunDemoKVLoadFailure(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = "127.0.0.1:0"
+		// каталог вместо файла - loadKVStore падает
+		cfg.KVPath = t.TempDir()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		runDemo(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runDemo hung after the server failed to load the kv store")
+	}
+}
+
+func TestRunDemoListenFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = busy.Addr().String()
+		cfg.KVPath = filepath.Join(t.TempDir(), "kv.json")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		runDemo(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runDemo hung after the server failed to listen")
+	}
+}
+
+func TestWaitAddrServerExited(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	if _, ok := waitAddr(context.Background(), make(chan string), done); ok {
+		t.Error("waitAddr reported an address from a server that exited")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := waitAddr(ctx, make(chan string), make(chan struct{})); ok {
+		t.Error("waitAddr reported an address after ctx was cancelled")
+	}
+}
+
+func TestApplyConfigRateLimit(t *testing.T) {
+	oldCfg, oldLevel := liveCfg.Load(), logLevel.Level()
+	t.Cleanup(func() {
+		liveCfg.Store(oldCfg)
+		logLevel.Set(oldLevel)
+	})
+
+	h := withLiveConfig(&rateLimiter{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	applyConfig(&reloadableConfig{})
+	for i := 0; i < 5; i++ {
+		if code := status(); code != http.StatusOK {
+			t.Fatalf("no limit: request %d got %d", i, code)
+		}
+	}
+
+	// новый лимит действует сразу, без пересоздания обработчика
+	applyConfig(&reloadableConfig{RateLimit: 2})
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := status(); code != want {
+			t.Fatalf("limit 2: request %d got %d, want %d", i, code, want)
+		}
+	}
+
+	applyConfig(&reloadableConfig{})
+	if code := status(); code != http.StatusOK {
+		t.Fatalf("limit removed: got %d", code)
+	}
+}
+
+func TestChaosErrorRate(t *testing.T) {
+	const (
+		total     = 4000
+		rate      = 0.25
+		tolerance = 0.05
+	)
+	h := withChaos(chaosConfig{ErrorRate: rate}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	failed := 0
+	for i := 0; i < total; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		switch rec.Code {
+		case http.StatusOK:
+		case http.StatusInternalServerError:
+			if rec.Header().Get("X-Chaos") != "error" {
+				t.Fatal("injected failure without X-Chaos header")
+			}
+			failed++
+		default:
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+
+	got := float64(failed) / total
+	if got < rate-tolerance || got > rate+tolerance {
+		t.Errorf("error rate = %.3f, want %.2f±%.2f", got, rate, tolerance)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want command
+	}{
+		{nil, command{name: "demo"}},
+		{[]string{"demo"}, command{name: "demo"}},
+		{[]string{"demo", "-http1", "-strict", "-trace", "t.json"}, command{name: "demo", forceHTTP1: true, strictJSON: true, tracePath: "t.json"}},
+		{[]string{"serve"}, command{name: "serve", addr: ":8080"}},
+		{[]string{"serve", "-addr", "127.0.0.1:9000"}, command{name: "serve", addr: "127.0.0.1:9000"}},
+		{[]string{"client", "http://localhost:8080/"}, command{name: "client", serverURL: "http://localhost:8080"}},
+		{[]string{"client", "-strict", "-trace", "c.json", "http://localhost:8080"}, command{name: "client", serverURL: "http://localhost:8080", strictJSON: true, tracePath: "c.json"}},
+	}
+	for _, tt := range tests {
+		got, err := parseCommand(tt.args)
+		if err != nil {
+			t.Errorf("parseCommand(%q): unexpected error %v", tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCommand(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseCommandErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"migrate"}, `unknown command "migrate"`},
+		{[]string{"client"}, "expected exactly one server URL, got 0 args"},
+		{[]string{"client", "http://a", "http://b"}, "expected exactly one server URL, got 2 args"},
+		{[]string{"serve", "-port", "80"}, "flag provided but not defined: -port"},
+	}
+	for _, tt := range tests {
+		_, err := parseCommand(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseCommand(%q): want error containing %q, got %v", tt.args, tt.want, err)
+		}
+	}
+}
+
+func TestBindQuery(t *testing.T) {
+	r := httptest.NewRequest("GET", "/sleep-then-stream?delay=10&chunks=3", nil)
+	q := sleepStreamQuery{Interval: 100}
+	if err := bindQuery(r, &q); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// незаданный параметр сохраняет значение по умолчанию
+	if q != (sleepStreamQuery{Delay: 10, Chunks: 3, Interval: 100}) {
+		t.Errorf("bindQuery = %+v", q)
+	}
+}
+
+func TestBindQueryErrors(t *testing.T) {
+	tests := []struct {
+		url  string
+		dst  interface{}
+		want []string
+	}{
+		{"/reset", &resetQuery{}, []string{`query param "mode" is required`}},
+		{"/reset?key=k", &resetQuery{}, []string{`query param "mode" is required`}},
+		{"/page?n=two", &pageQuery{}, []string{`query param "n": "two" is not a valid int`}},
+		{"/sleep-then-stream?delay=x&chunks=1.5", &sleepStreamQuery{}, []string{
+			`query param "delay": "x" is not a valid int`,
+			`query param "chunks": "1.5" is not a valid int`,
+		}},
+		{"/page", pageQuery{}, []string{"dst must be a pointer to struct"}},
+	}
+	for _, tt := range tests {
+		err := bindQuery(httptest.NewRequest("GET", tt.url, nil), tt.dst)
+		if err == nil {
+			t.Errorf("bindQuery(%s): want error, got nil", tt.url)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("bindQuery(%s) = %q, want it to contain %q", tt.url, err, want)
+			}
+		}
+	}
+}
+
+func TestResetHandlerRequiresMode(t *testing.T) {
+	for _, url := range []string{"/reset", "/reset?mode=fin"} {
+		rec := httptest.NewRecorder()
+		(&resetHandler{}).ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", url, rec.Code)
+		}
+	}
+}
+
+func TestWriteChromeTrace(t *testing.T) {
+	old := tracer
+	tracer = newSpanCollector()
+	t.Cleanup(func() { tracer = old })
+
+	// два одновременных клиентских запроса и один серверный
+	endJSON := tracer.start("GET /json", clientPid)
+	endSlow := tracer.start("GET /slow", clientPid)
+	withTracing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	endSlow()
+	endJSON()
+
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if err := tracer.writeChromeTrace(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []chromeEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.Fatalf("trace is not valid JSON: %v", err)
+	}
+
+	spans := map[string]chromeEvent{}
+	processes := map[int]string{}
+	for _, ev := range events {
+		switch ev.Ph {
+		case "M":
+			processes[ev.Pid] = ev.Args["name"]
+		case "X":
+			spans[ev.Name] = ev
+		default:
+			t.Errorf("unexpected event phase %q", ev.Ph)
+		}
+	}
+	if processes[clientPid] != "client" || processes[serverPid] != "server" {
+		t.Errorf("process names = %v", processes)
+	}
+	if len(events) != 5 {
+		t.Errorf("got %d events, want 2 metadata + 3 spans", len(events))
+	}
+	for name, pid := range map[string]int{"GET /json": clientPid, "GET /slow": clientPid, "GET /healthz": serverPid} {
+		if ev, ok := spans[name]; !ok || ev.Pid != pid {
+			t.Errorf("span %q = %+v, ok=%v, want pid %d", name, ev, ok, pid)
+		}
+	}
+	if spans["GET /json"].Tid == spans["GET /slow"].Tid {
+		t.Error("overlapping client spans share a lane")
+	}
+}
+
+func TestClientRetriesOnlyIdempotent(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client := NewClient(WithBaseURL(srv.URL), WithRetries(2))
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		do   func() (*http.Response, error)
+		want int32
+	}{
+		{"Get", func() (*http.Response, error) { return client.Get(ctx, "/") }, 3},
+		{"Post", func() (*http.Response, error) { return client.Post(ctx, "/", "text/plain", []byte("x")) }, 1},
+		{"PostJSON", func() (*http.Response, error) { return client.PostJSON(ctx, "/", User{ID: 1}) }, 1},
+	}
+	for _, tt := range tests {
+		calls.Store(0)
+		resp, err := tt.do()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: status %d, want 503", tt.name, resp.StatusCode)
+		}
+		if got := calls.Load(); got != tt.want {
+			t.Errorf("%s: server saw %d requests, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// jsonGarbage - заведомо битые тела для /json, затравка для FuzzJSONHandler
+var jsonGarbage = [][]byte{
+	nil,
+	[]byte("{"),
+	[]byte(`{"id": "42"}`),
+	[]byte(`{"id": 1e400}`),
+	[]byte(`{"id": 42, "user": }`),
+	[]byte(`{"id": 42} {"id": 43}`),
+	[]byte(`{"id": 42}]`),
+	[]byte(`[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[`),
+	bytes.Repeat([]byte{'"'}, 1000),
+}
+
+// FuzzJSONHandler: на любое тело /json отвечает либо 200 с пользователем
+// (и тогда тело - валидный JSON), либо 4xx с разбираемой jsonError
+func FuzzJSONHandler(f *testing.F) {
+	for _, payload := range jsonGarbage {
+		f.Add(payload)
+	}
+	f.Add([]byte(`{"id": 42, "user": "rvasily"}`))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		rec := httptest.NewRecorder()
+		jsonHandler(rec, httptest.NewRequest("POST", "/json", bytes.NewReader(payload)))
+
+		switch {
+		case rec.Code == http.StatusOK:
+			if !json.Valid(payload) {
+				t.Fatalf("200 for invalid JSON %q", payload)
+			}
+			res := jsonResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Status != "ok" {
+				t.Fatalf("bad 200 response %q: %v", rec.Body, err)
+			}
+		case rec.Code/100 == 4:
+			res := jsonError{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Error == "" {
+				t.Fatalf("status %d with unparseable error %q: %v", rec.Code, rec.Body, err)
+			}
+		default:
+			t.Fatalf("unexpected status %d for %q", rec.Code, payload)
+		}
+	})
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Path", r.URL.Path)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RawQuery, body)
+	}))
+	recorder := &RecordingTransport{Base: http.DefaultTransport}
+	client := NewClient(WithBaseURL(srv.URL), WithTransport(recorder))
+	ctx := context.Background()
+
+	get, err := client.GetBytes(ctx, "/items?a=1&b=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(ctx, "/items", "text/plain", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	srv.Close()
+
+	path := filepath.Join(t.TempDir(), "transcript.json")
+	if err := recorder.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := NewReplayTransport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// другой хост и другой порядок query - запись всё равно находится
+	client = NewClient(WithBaseURL("http://replay.invalid:1"), WithTransport(replay))
+	got, err := client.GetBytes(ctx, "/items?b=2&a=1")
+	if err != nil {
+		t.Fatalf("replay GET: %v", err)
+	}
+	if string(got) != string(get) {
+		t.Errorf("replay GET = %q, want %q", got, get)
+	}
+
+	if _, err := client.Post(ctx, "/items", "text/plain", []byte("other")); !errors.Is(err, errNoRecording) {
+		t.Errorf("POST with a different body: want errNoRecording, got %v", err)
+	}
+	resp, err = client.Post(ctx, "/items", "text/plain", []byte("new"))
+	if err != nil {
+		t.Fatalf("replay POST: %v", err)
+	}
+	got, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(got) != string(post) || resp.Header.Get("X-Path") != "/items" {
+		t.Errorf("replay POST = %q %v, want %q", got, resp.Header, post)
+	}
+
+	// каждая запись отдаётся один раз
+	if _, err := client.GetBytes(ctx, "/items?a=1&b=2"); !errors.Is(err, errNoRecording) {
+		t.Errorf("second replay GET: want errNoRecording, got %v", err)
+	}
+}
+
+func TestRetryDial(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		name  string
+		errs  []error
+		want  int
+		fails bool
+	}{
+		{"refused then up", []error{refused, refused, nil}, 3, false},
+		{"refused until retries run out", []error{refused, refused, refused, refused, refused}, 4, true},
+		{"dns error is not retried", []error{&net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}}, 1, true},
+		{"timeout is not retried", []error{context.DeadlineExceeded}, 1, true},
+	}
+	for _, tt := range tests {
+		calls := 0
+		fake := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			err := tt.errs[calls]
+			calls++
+			if err != nil {
+				return nil, err
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		conn, err := retryDial(fake, 3, time.Millisecond)(context.Background(), "tcp", "127.0.0.1:1")
+		if conn != nil {
+			conn.Close()
+		}
+		if calls != tt.want || (err != nil) != tt.fails {
+			t.Errorf("%s: %d dials, err %v; want %d dials, failure %v", tt.name, calls, err, tt.want, tt.fails)
+		}
+	}
+}
+
+// checkJSONSchema проверяет, что в JSON-объекте body есть все поля schema
+// с указанными типами в терминах jsonType: "number", "string", "boolean",
+// "array", "object", "null"; лишние поля не мешают
+func checkJSONSchema(body []byte, schema map[string]string) error {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return fmt.Errorf("body is not a JSON object: %w", err)
+	}
+
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var errs []error
+	for _, name := range names {
+		value, ok := obj[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("missing field %q", name))
+			continue
+		}
+		if got := jsonType(value); got != schema[name] {
+			errs = append(errs, fmt.Errorf("field %q: want %s, got %s", name, schema[name], got))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// assertJSONSchema - тестовая обёртка над checkJSONSchema
+func assertJSONSchema(t testing.TB, body []byte, schema map[string]string) {
+	t.Helper()
+	if err := checkJSONSchema(body, schema); err != nil {
+		t.Errorf("schema mismatch in %s: %v", bytes.TrimSpace(body), err)
+	}
+}
+
+func TestEndpointContracts(t *testing.T) {
+	tests := []struct {
+		path    string
+		handler http.Handler
+		schema  map[string]string
+	}{
+		{"/uuid", http.HandlerFunc(uuidHandler), map[string]string{"uuid": "string"}},
+		{"/healthz", http.HandlerFunc(healthzHandler), map[string]string{"status": "string"}},
+		{"/version", http.HandlerFunc(versionHandler), map[string]string{"version": "string", "go": "string"}},
+		{"/count", &countHandler{}, map[string]string{"count": "number"}},
+		{"/env", envHandler([]string{"PATH", "REQUESTS_TEST_UNSET"}), map[string]string{"vars": "object", "absent": "array"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d", tt.path, rec.Code)
+			continue
+		}
+		assertJSONSchema(t, rec.Body.Bytes(), tt.schema)
+	}
+}
+
+func TestCheckJSONSchemaMismatch(t *testing.T) {
+	tests := []struct {
+		body   string
+		schema map[string]string
+		want   []string
+	}{
+		{`{"uuid": "x"}`, map[string]string{"uuid": "number"}, []string{`field "uuid": want number, got string`}},
+		{`{"status": "ok"}`, map[string]string{"status": "string", "uptime": "number"}, []string{`missing field "uptime"`}},
+		{`{"a": null, "b": [1]}`, map[string]string{"a": "object", "b": "object", "c": "string"}, []string{
+			`field "a": want object, got null`,
+			`field "b": want object, got array`,
+			`missing field "c"`,
+		}},
+		{`[1, 2]`, map[string]string{"a": "number"}, []string{"body is not a JSON object"}},
+		{`{"a": `, map[string]string{"a": "number"}, []string{"body is not a JSON object"}},
+	}
+	for _, tt := range tests {
+		err := checkJSONSchema([]byte(tt.body), tt.schema)
+		if err == nil {
+			t.Errorf("checkJSONSchema(%s): want error, got nil", tt.body)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("checkJSONSchema(%s) = %q, want it to contain %q", tt.body, err, want)
+			}
+		}
+	}
+}
+
+// failRecorder ловит вызовы Errorf, чтобы проверить сам assertJSONSchema
+type failRecorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *failRecorder) Helper() {}
+
+func (r *failRecorder) Errorf(format string, args ...interface{}) { r.failed = true }
+
+func TestAssertJSONSchema(t *testing.T) {
+	ok := &failRecorder{}
+	assertJSONSchema(ok, []byte(`{"count": 1, "extra": true}`), map[string]string{"count": "number"})
+	if ok.failed {
+		t.Error("assertJSONSchema failed on a matching body")
+	}
+
+	bad := &failRecorder{}
+	assertJSONSchema(bad, []byte(`{"count": "1"}`), map[string]string{"count": "number"})
+	if !bad.failed {
+		t.Error("assertJSONSchema passed a mismatching body")
+	}
+}
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) { cfg.MaxRequestTimeout = 5 * time.Second })
+	h := withRequestTimeout(http.HandlerFunc(slowHandler))
+
+	req := httptest.NewRequest("GET", "/slow?ms=500", nil)
+	req.Header.Set("X-Request-Timeout", "50")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("handler ran %v, the 50ms timeout was not applied", elapsed)
+	}
+}
+
+func TestRequestTimeoutHeaderCapped(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) { cfg.MaxRequestTimeout = 50 * time.Millisecond })
+
+	var remaining time.Duration
+	probe := withRequestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := r.Context().Deadline()
+		if !ok {
+			t.Error("no deadline on the request context")
+		}
+		remaining = time.Until(deadline)
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Timeout", "60000")
+	probe.ServeHTTP(httptest.NewRecorder(), req)
+	if remaining > 50*time.Millisecond {
+		t.Errorf("deadline in %v, want it clamped to MaxRequestTimeout 50ms", remaining)
+	}
+
+	// и на деле: 500мс работы обрываются по потолку, а не по заголовку
+	req = httptest.NewRequest("GET", "/slow?ms=500", nil)
+	req.Header.Set("X-Request-Timeout", "60000")
+	rec := httptest.NewRecorder()
+	withRequestTimeout(http.HandlerFunc(slowHandler)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+}
+
+func TestConnectionCloseRedials(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	mux.HandleFunc("/close", closeHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	steps := []struct {
+		path      string
+		close     bool
+		wantDials int
+	}{
+		{"/", false, 1},
+		{"/", false, 1},
+		{"/", true, 1}, // идёт по старому соединению и закрывает его
+		{"/", false, 2},
+		{"/close", false, 2}, // то же, но закрывает сервер
+		{"/", false, 3},
+	}
+	ct := &connTrace{}
+	for i, step := range steps {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+step.path, nil)
+		req.Close = step.close
+		resp, err := client.Do(ct.wrap(req))
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ct.dials != step.wantDials {
+			t.Errorf("step %d (%s, close=%v): dials = %d, want %d", i, step.path, step.close, ct.dials, step.wantDials)
+		}
+	}
+}
+
+// startTestServer поднимает startServer и останавливает его в t.Cleanup
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	serverURL, _ := startStoppableServer(t)
+	return serverURL
+}
+
+// startStoppableServer - startTestServer, который можно остановить посреди теста
+func startStoppableServer(t *testing.T) (string, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		startServer(ctx, addr)
+		close(done)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	a, ok := waitAddr(ctx, addr, done)
+	if !ok {
+		t.Fatal("server did not start")
+	}
+	return "http://" + a, stop
+}
+
+func TestIdleConnReleasesLimitSlot(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = "127.0.0.1:0"
+		cfg.KVPath = filepath.Join(t.TempDir(), "kv.json")
+		cfg.MaxConns = 1
+		cfg.IdleTimeout = 100 * time.Millisecond
+	})
+	serverURL := startTestServer(t)
+
+	get := func(tr *http.Transport) error {
+		resp, err := (&http.Client{Transport: tr, Timeout: 2 * time.Second}).Get(serverURL + "/ping")
+		if err != nil {
+			return err
+		}
+		ioutil.ReadAll(resp.Body)
+		return resp.Body.Close()
+	}
+	// idle держит единственный слот, пока сервер не закроет его по IdleTimeout
+	idle, other := &http.Transport{}, &http.Transport{}
+	defer idle.CloseIdleConnections()
+	defer other.CloseIdleConnections()
+	if err := get(idle); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(other); err != nil {
+		t.Fatalf("second client locked out by an idle connection: %v", err)
+	}
+}
+
+func TestConnLimiterRotatesConnections(t *testing.T) {
+	const limit = 3
+	conns := newConnLimiter(limit, 0)
+	srv := httptest.NewUnstartedServer(conns.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	})))
+	srv.Config.ConnContext = conns.connContext
+	srv.Config.ConnState = conns.connState
+	srv.Start()
+	defer srv.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	ct := &connTrace{}
+	var redialAt []int
+	for i := 1; i <= 2*limit+1; i++ {
+		dials := ct.dials
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		resp, err := client.Do(ct.wrap(req))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ct.dials != dials {
+			redialAt = append(redialAt, i)
+		}
+	}
+	if fmt.Sprint(redialAt) != fmt.Sprint([]int{1, limit + 1, 2*limit + 1}) {
+		t.Errorf("new connections at requests %v, want every %d requests", redialAt, limit)
+	}
+}
+
+func TestConnLimiterDisabledKeepsConnection(t *testing.T) {
+	conns := newConnLimiter(0, 0)
+	srv := httptest.NewUnstartedServer(conns.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	srv.Config.ConnContext = conns.connContext
+	srv.Config.ConnState = conns.connState
+	srv.Start()
+	defer srv.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	ct := &connTrace{}
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		resp, err := (&http.Client{Transport: transport}).Do(ct.wrap(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if ct.dials != 1 {
+		t.Errorf("dials = %d, want 1 with rotation disabled", ct.dials)
+	}
+}
+
+func TestReadHeaderTimeoutClosesSlowClient(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = "127.0.0.1:0"
+		cfg.KVPath = filepath.Join(t.TempDir(), "kv.json")
+		cfg.ReadHeaderTimeout = timeout
+	})
+	serverURL := startTestServer(t)
+
+	resp, err := http.Get(serverURL + "/slowloris-guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /slowloris-guard: status %d", resp.StatusCode)
+	}
+
+	addr := strings.TrimPrefix(serverURL, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// строка запроса по байту раз в 50мс - заголовки так и не заканчиваются
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		request := "GET /slowloris-guard HTTP/1.1\r\nHost: " + addr + "\r\nX-Padding: "
+		for i := 0; ; i++ {
+			b := []byte{'x'}
+			if i < len(request) {
+				b[0] = request[i]
+			}
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(10 * timeout))
+	reply, err := ioutil.ReadAll(conn)
+	elapsed := time.Since(start)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("connection still open after %v", elapsed)
+	}
+	if elapsed < timeout || elapsed > 5*timeout {
+		t.Errorf("closed after %v, want about ReadHeaderTimeout %v", elapsed, timeout)
+	}
+	if bytes.Contains(reply, []byte("slowlorisGuardHandler")) {
+		t.Error("handler ran for a client that never finished its headers")
+	}
+}
+
+func TestTLSProtocolNegotiation(t *testing.T) {
+	cert, roots, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		startTLSServer(ctx, cert, addr)
+		close(done)
+	}()
+	a, ok := waitAddr(ctx, addr, done)
+	if !ok {
+		t.Fatal("tls server did not start")
+	}
+
+	for forceHTTP1, want := range map[bool]string{false: "HTTP/2.0", true: "HTTP/1.1"} {
+		resp, err := newTLSClient(roots, forceHTTP1).Get("https://" + a)
+		if err != nil {
+			t.Fatalf("force_http1=%v: %v", forceHTTP1, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Proto != want {
+			t.Errorf("force_http1=%v: client proto %s, want %s", forceHTTP1, resp.Proto, want)
+		}
+		if !strings.Contains(string(body), want) {
+			t.Errorf("force_http1=%v: server saw %q, want %s", forceHTTP1, body, want)
+		}
+	}
+}
+
+func newUserTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	users := newUserStore()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", users.handleGet)
+	mux.HandleFunc("PUT /users/{id}", users.handleUpdate)
+	mux.HandleFunc("PATCH /users/{id}", users.handleUpdate)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func doUserRequest(t *testing.T, method, url, ifMatch, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestConditionalPutRace(t *testing.T) {
+	userURL := newUserTestServer(t).URL + "/users/42"
+
+	// оба клиента прочитали одну и ту же версию
+	first := doUserRequest(t, http.MethodGet, userURL, "", "")
+	second := doUserRequest(t, http.MethodGet, userURL, "", "")
+	etag := first.Header.Get("ETag")
+	if etag == "" || second.Header.Get("ETag") != etag {
+		t.Fatalf("ETags %q and %q, want equal and non-empty", etag, second.Header.Get("ETag"))
+	}
+
+	resp := doUserRequest(t, http.MethodPut, userURL, etag, `{"user": "first"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first write: status %d, want 200", resp.StatusCode)
+	}
+	fresh := resp.Header.Get("ETag")
+	if fresh == etag {
+		t.Errorf("ETag did not change after a write: %s", fresh)
+	}
+
+	resp = doUserRequest(t, http.MethodPut, userURL, etag, `{"user": "second"}`)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("write with stale ETag: status %d, want 412", resp.StatusCode)
+	}
+
+	resp = doUserRequest(t, http.MethodPatch, userURL, fresh, `{"user": "second"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("retry with fresh ETag: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestUserStoreUpdate(t *testing.T) {
+	s := newUserStore()
+	_, etag, err := s.get(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rename := func(u *User) error { u.User = "renamed"; return nil }
+
+	if _, _, err := s.update(42, etag, rename); err != nil {
+		t.Fatalf("update with current ETag: %v", err)
+	}
+	if _, _, err := s.update(42, etag, rename); !errors.Is(err, errPreconditionFailed) {
+		t.Errorf("update with stale ETag: want errPreconditionFailed, got %v", err)
+	}
+	if _, _, err := s.update(42, "*", rename); err != nil {
+		t.Errorf("update with If-Match *: %v", err)
+	}
+	if _, _, err := s.update(7, "", rename); !errors.Is(err, errUserNotFound) {
+		t.Errorf("update of missing user: want errUserNotFound, got %v", err)
+	}
+}
+
+func TestChunkedUploadReassembly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(uploadHandler))
+	defer srv.Close()
+
+	var chunks [][]byte
+	hash := sha256.New()
+	total := 0
+	for i := 0; i < 5; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i)}, 1000+i)
+		chunks = append(chunks, chunk)
+		hash.Write(chunk)
+		total += len(chunk)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for _, chunk := range chunks {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		pw.Close()
+	}()
+
+	resp, err := http.Post(srv.URL, "application/octet-stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	res := uploadResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Bytes != int64(total) {
+		t.Errorf("bytes = %d, want %d", res.Bytes, total)
+	}
+	if want := hex.EncodeToString(hash.Sum(nil)); res.SHA256 != want {
+		t.Errorf("sha256 = %s, want %s", res.SHA256, want)
+	}
+	if fmt.Sprint(res.TransferEncoding) != "[chunked]" {
+		t.Errorf("transfer encoding = %v, want [chunked]", res.TransferEncoding)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	h := withCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/users/42", nil))
+	var token *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			token = c
+		}
+	}
+	if rec.Code != http.StatusOK || token == nil || token.Value == "" {
+		t.Fatalf("GET: status %d, csrf cookie %v", rec.Code, token)
+	}
+
+	tests := []struct {
+		name   string
+		cookie bool
+		header string
+		want   int
+	}{
+		{"no cookie, no header", false, "", http.StatusForbidden},
+		{"missing token", true, "", http.StatusForbidden},
+		{"mismatched token", true, "forged", http.StatusForbidden},
+		{"header without cookie", false, token.Value, http.StatusForbidden},
+		{"matching token", true, token.Value, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("PATCH", "/users/42", strings.NewReader(`{"user": "rvasily"}`))
+		if tt.cookie {
+			req.AddCookie(token)
+		}
+		if tt.header != "" {
+			req.Header.Set(csrfHeaderName, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header      string
+		start, size int64
+	}{
+		{"bytes 100-199/1000", 100, 1000},
+		{"bytes 0-0/1", 0, 1},
+		{"bytes */1000", -1, 1000},
+	}
+	for _, tt := range tests {
+		start, size, err := parseContentRange(tt.header)
+		if err != nil || start != tt.start || size != tt.size {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v; want %d, %d", tt.header, start, size, err, tt.start, tt.size)
+		}
+	}
+	for _, header := range []string{"", "bytes 1-2", "items 0-1/2", "bytes x-1/2", "bytes */?"} {
+		if _, _, err := parseContentRange(header); err == nil {
+			t.Errorf("parseContentRange(%q): want error", header)
+		}
+	}
+}
+
+func TestDownloadToFile(t *testing.T) {
+	const size = 10000
+	srv := httptest.NewServer(http.HandlerFunc(downloadHandler))
+	defer srv.Close()
+	url := fmt.Sprintf("%s/download?size=%d", srv.URL, size)
+	want := downloadData(size)
+
+	tests := []struct {
+		name    string
+		local   []byte // nil - файла ещё нет
+		wantErr bool
+	}{
+		{"fresh", nil, false},
+		{"resume", want[:3000], false},
+		{"complete", want, false},
+		{"oversized", append(append([]byte{}, want...), "extra"...), true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "download.bin")
+		if tt.local != nil {
+			if err := os.WriteFile(path, tt.local, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var lastWritten, lastTotal int64
+		err := downloadToFile(context.Background(), http.DefaultClient, url, path, func(written, total int64) {
+			lastWritten, lastTotal = written, total
+		})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got nil", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, _ := os.ReadFile(path)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: file has %d bytes, not the %d served", tt.name, len(got), size)
+		}
+		if lastWritten != size || lastTotal != size {
+			t.Errorf("%s: last progress %d/%d, want %d/%d", tt.name, lastWritten, lastTotal, size, size)
+		}
+	}
+}
+
+func TestExpensiveHandlerCoalesces(t *testing.T) {
+	h := &expensiveHandler{}
+	results := make([]expensiveResult, 10)
+
+	start := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/expensive?q=thundering-herd", nil))
+			json.Unmarshal(rec.Body.Bytes(), &results[i])
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if got := h.computations.Load(); got != 1 {
+		t.Errorf("computations = %d, want 1 for 10 concurrent requests", got)
+	}
+	for i, res := range results {
+		if res.Result == "" || res.Result != results[0].Result {
+			t.Errorf("request %d got result %q, want %q", i, res.Result, results[0].Result)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/expensive?q=other", nil))
+	if got := h.computations.Load(); got != 2 {
+		t.Errorf("computations = %d after a different key, want 2", got)
+	}
+}
+
+func TestCountHandler(t *testing.T) {
+	h := &countHandler{}
+	do := func(method string) (int, countResult) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/count", nil))
+		res := countResult{}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+
+	for want := int64(1); want <= 3; want++ {
+		if _, res := do("GET"); res.Count != want {
+			t.Errorf("GET #%d: count = %d", want, res.Count)
+		}
+	}
+	if _, res := do("DELETE"); res.Previous != 3 || res.Count != 0 {
+		t.Errorf("DELETE = %+v, want previous 3", res)
+	}
+	if _, res := do("GET"); res.Count != 1 {
+		t.Errorf("GET after reset: count = %d, want 1", res.Count)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/count", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, DELETE" {
+		t.Errorf("POST: status %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	if _, res := do("GET"); res.Count != 2 {
+		t.Errorf("rejected POST changed the counter: count = %d, want 2", res.Count)
+	}
+}
+
+func authRequest(header string) *http.Request {
+	r := httptest.NewRequest("GET", "/whoami", nil)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+	return r
+}
+
+func TestBasicAuthenticator(t *testing.T) {
+	a := basicAuthenticator{users: map[string]string{"rvasily": "secret"}}
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	if principal, err := a.Authenticate(authRequest(basic("rvasily", "secret"))); err != nil || principal != "rvasily" {
+		t.Errorf("valid credentials: %q, %v", principal, err)
+	}
+	tests := []struct {
+		header string
+		want   error
+	}{
+		{"", errNoCredentials},
+		{"Bearer demo-token", errNoCredentials},
+		{basic("rvasily", "wrong"), errBadCredentials},
+		{basic("nobody", "secret"), errBadCredentials},
+	}
+	for _, tt := range tests {
+		if _, err := a.Authenticate(authRequest(tt.header)); !errors.Is(err, tt.want) {
+			t.Errorf("Authorization %q: want %v, got %v", tt.header, tt.want, err)
+		}
+	}
+}
+
+func TestBearerAuthenticator(t *testing.T) {
+	secret := []byte("test-secret")
+	a := bearerAuthenticator{tokens: map[string]string{"demo-token": "service-account"}, secret: secret}
+	now := time.Now()
+	jwt := func(claims jwtClaims, secret []byte) string {
+		token, err := signJWT(claims, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := jwt(jwtClaims{Sub: "rvasily", Exp: now.Add(time.Minute).Unix()}, secret)
+	noExp := jwt(jwtClaims{Sub: "svc"}, secret)
+	for header, want := range map[string]string{
+		"Bearer demo-token": "service-account",
+		"Bearer " + valid:   "rvasily",
+		"Bearer " + noExp:   "svc",
+	} {
+		if principal, err := a.Authenticate(authRequest(header)); err != nil || principal != want {
+			t.Errorf("Authorization %q: %q, %v; want %q", header, principal, err, want)
+		}
+	}
+
+	// подпись своя, но payload подменён
+	parts := strings.Split(valid, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))
+	tampered := strings.Join(parts, ".")
+
+	tests := []struct {
+		name   string
+		header string
+		want   error
+	}{
+		{"no header", "", errNoCredentials},
+		{"basic scheme", "Basic cnZhc2lseTpzZWNyZXQ=", errNoCredentials},
+		{"unknown static token", "Bearer nope", errBadCredentials},
+		{"expired jwt", "Bearer " + jwt(jwtClaims{Sub: "rvasily", Exp: now.Add(-time.Minute).Unix()}, secret), errBadCredentials},
+		{"forged jwt", "Bearer " + jwt(jwtClaims{Sub: "rvasily"}, []byte("other-secret")), errBadCredentials},
+		{"tampered payload", "Bearer " + tampered, errBadCredentials},
+	}
+	for _, tt := range tests {
+		if _, err := a.Authenticate(authRequest(tt.header)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	secret := []byte("test-secret")
+	now := time.Unix(1700000000, 0)
+	token, _ := signJWT(jwtClaims{Sub: "rvasily", Exp: now.Unix() + 60}, secret)
+
+	if sub, err := verifyJWT(token, secret, now); err != nil || sub != "rvasily" {
+		t.Errorf("valid token: %q, %v", sub, err)
+	}
+	_, err := verifyJWT(token, secret, now.Add(time.Minute))
+	if !errors.Is(err, errBadCredentials) || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("at exp: want expired error, got %v", err)
+	}
+	if _, err := verifyJWT(token, []byte("other-secret"), now); !errors.Is(err, errBadCredentials) {
+		t.Errorf("wrong secret: want errBadCredentials, got %v", err)
+	}
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	parts := strings.Split(token, ".")
+	noSub, _ := signJWT(jwtClaims{}, secret)
+	for _, bad := range []string{"", "a.b", none + "." + parts[1] + ".", "!!." + parts[1] + "." + parts[2], noSub} {
+		if _, err := verifyJWT(bad, secret, now); !errors.Is(err, errBadCredentials) {
+			t.Errorf("verifyJWT(%q): want errBadCredentials, got %v", bad, err)
+		}
+	}
+}
+
+func TestClientDeadlineIsRequestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(slowHandler))
+	defer srv.Close()
+	url := srv.URL + "/slow?ms=500"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res := fetch(ctx, http.DefaultClient, url)
+	if !errors.Is(res.Err, ErrRequestTimeout) {
+		t.Errorf("context deadline: want ErrRequestTimeout, got %v", res.Err)
+	}
+	if res.Duration > 400*time.Millisecond {
+		t.Errorf("context deadline: request took %v", res.Duration)
+	}
+
+	res = fetch(context.Background(), &http.Client{Timeout: 100 * time.Millisecond}, url)
+	if !errors.Is(res.Err, ErrRequestTimeout) {
+		t.Errorf("client timeout: want ErrRequestTimeout, got %v", res.Err)
+	}
+}
+
+func TestAdmissionControlOverload(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = "127.0.0.1:0"
+		cfg.KVPath = filepath.Join(t.TempDir(), "kv.json")
+		cfg.MaxInFlight = 2
+		cfg.QueueSize = 2
+		cfg.QueueWait = time.Second
+	})
+	serverURL := startTestServer(t)
+
+	const total = 10
+	statuses := make([]int, total)
+	retryAfter := make([]string, total)
+	wg := &sync.WaitGroup{}
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(serverURL + "/slow?ms=200")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			statuses[i], retryAfter[i] = resp.StatusCode, resp.Header.Get("Retry-After")
+		}()
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for i, status := range statuses {
+		counts[status]++
+		if status == http.StatusServiceUnavailable && retryAfter[i] == "" {
+			t.Error("503 without Retry-After")
+		}
+	}
+	// 2 сразу, 2 из очереди, остальные - отказ без ожидания
+	if counts[http.StatusOK] != 4 || counts[http.StatusServiceUnavailable] != total-4 {
+		t.Errorf("statuses %v, want 4 ok and %d rejected", counts, total-4)
+	}
+
+	resp, err := http.Get(serverURL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	res := struct {
+		Admission admissionMetrics `json:"admission"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	m := res.Admission
+	// сам запрос /metrics тоже прошёл через admission
+	if m.Admitted+m.Queued != int64(counts[http.StatusOK])+1 || m.Queued < 1 ||
+		m.Rejected != int64(counts[http.StatusServiceUnavailable]) || m.Waiting != 0 {
+		t.Errorf("metrics %+v do not match statuses %v", m, counts)
+	}
+}
+
+func TestWithSignature(t *testing.T) {
+	secret := []byte("test-secret")
+	var gotBody string
+	h := withSignature(secret, time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+	}))
+	body := []byte(`{"id": 42}`)
+	newReq := func(target string, payload []byte) *http.Request {
+		return httptest.NewRequest("POST", target, bytes.NewReader(payload))
+	}
+	serve := func(r *http.Request) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	req := newReq("/json?v=1", body)
+	signRequest(req, body, secret)
+	if code := serve(req); code != http.StatusOK || gotBody != string(body) {
+		t.Errorf("valid signature: status %d, handler body %q", code, gotBody)
+	}
+
+	// подписали одно тело, отправили другое
+	req = newReq("/json?v=1", []byte(`{"id": 43}`))
+	signRequest(req, body, secret)
+	if code := serve(req); code != http.StatusUnauthorized {
+		t.Errorf("tampered body: status %d, want 401", code)
+	}
+
+	req = newReq("/json?v=1", body)
+	signRequest(req, body, secret)
+	req.URL.RawQuery, req.RequestURI = "v=2", "/json?v=2"
+	if code := serve(req); code != http.StatusUnauthorized {
+		t.Errorf("tampered query: status %d, want 401", code)
+	}
+
+	req = newReq("/json?v=1", body)
+	signRequest(req, body, []byte("other-secret"))
+	if code := serve(req); code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: status %d, want 401", code)
+	}
+
+	// подпись верная, но запрос старше допустимого сдвига
+	stale := time.Now().Add(-2 * time.Minute).Unix()
+	req = newReq("/json?v=1", body)
+	req.Header.Set("X-Timestamp", strconv.FormatInt(stale, 10))
+	req.Header.Set("X-Signature", hex.EncodeToString(requestMAC(secret, "POST", "/json?v=1", stale, body)))
+	if code := serve(req); code != http.StatusUnauthorized {
+		t.Errorf("stale timestamp: status %d, want 401", code)
+	}
+
+	if code := serve(newReq("/json?v=1", body)); code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: status %d, want 401", code)
+	}
+}
+
+// roundTripFunc - транспорт из функции для тестов
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestClientOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ms := r.URL.Query().Get("sleep"); ms != "" {
+			d, _ := time.ParseDuration(ms + "ms")
+			time.Sleep(d)
+		}
+		fmt.Fprintf(w, "%s %s ua=%s", r.Host, r.URL.Path, r.Header.Get("User-Agent"))
+	}))
+	defer srv.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "other %s", r.URL.Path)
+	}))
+	defer other.Close()
+	ctx := context.Background()
+
+	t.Run("base URL and absolute URLs", func(t *testing.T) {
+		c := NewClient(WithBaseURL(srv.URL + "/"))
+		if got := c.url("/a"); got != srv.URL+"/a" {
+			t.Errorf("url(/a) = %s, trailing slash of the base not trimmed", got)
+		}
+		body, err := c.GetBytes(ctx, other.URL+"/abs")
+		if err != nil || string(body) != "other /abs" {
+			t.Errorf("absolute URL: %q, %v; want it to bypass the base URL", body, err)
+		}
+		if got := NewClient().url("/rel"); got != "/rel" {
+			t.Errorf("no base URL: url(/rel) = %s", got)
+		}
+	})
+
+	t.Run("default header", func(t *testing.T) {
+		c := NewClient(WithBaseURL(srv.URL), WithDefaultHeader("User-Agent", "coursera/golang"))
+		body, err := c.GetBytes(ctx, "/h")
+		if err != nil || !strings.HasSuffix(string(body), "ua=coursera/golang") {
+			t.Errorf("default header: %q, %v", body, err)
+		}
+		resp, err := c.Post(ctx, "/h", "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		post, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.HasSuffix(string(post), "ua=coursera/golang") {
+			t.Errorf("default header on POST: %q", post)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		c := NewClient(WithBaseURL(srv.URL), WithTimeout(50*time.Millisecond))
+		if _, err := c.GetBytes(ctx, "/t?sleep=300"); !errors.Is(err, ErrRequestTimeout) {
+			t.Errorf("want ErrRequestTimeout, got %v", err)
+		}
+		if _, err := c.GetBytes(ctx, "/t"); err != nil {
+			t.Errorf("fast request with timeout: %v", err)
+		}
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		var seen []string
+		rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			seen = append(seen, r.Method+" "+r.URL.String()+" "+r.Header.Get("User-Agent"))
+			return http.DefaultTransport.RoundTrip(r)
+		})
+		c := NewClient(WithTransport(rt), WithBaseURL(srv.URL), WithDefaultHeader("User-Agent", "ua"), WithTimeout(time.Second))
+		if _, err := c.GetBytes(ctx, "/x"); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(seen) != fmt.Sprint([]string{"GET " + srv.URL + "/x ua"}) {
+			t.Errorf("custom transport saw %q", seen)
+		}
+	})
+}
+
+func TestDNSErrorClassified(t *testing.T) {
+	fakeDNS := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: "example.test", IsNotFound: true}}
+	}}
+	_, err := NewClient(WithTransport(fakeDNS)).Get(context.Background(), "http://example.test/")
+	var dnsErr *net.DNSError
+	if !errors.Is(err, ErrDNSLookup) || !errors.As(err, &dnsErr) || dnsErr.Name != "example.test" {
+		t.Errorf("fake DNS failure: want ErrDNSLookup wrapping *net.DNSError, got %v", err)
+	}
+	if errors.Is(err, ErrRequestTimeout) || errors.Is(err, ErrConnectionReset) {
+		t.Errorf("DNS failure also classified as another error: %v", err)
+	}
+
+	// .invalid по RFC 2606 не разрешается никогда
+	_, err = NewClient(WithTimeout(5*time.Second)).Get(context.Background(), "http://nonexistent.invalid/")
+	if !errors.Is(err, ErrDNSLookup) {
+		t.Errorf("nonexistent host: want ErrDNSLookup, got %v", err)
+	}
+
+	if again := classifyErr(err); strings.Count(again.Error(), ErrDNSLookup.Error()) != 1 {
+		t.Errorf("classifyErr wrapped ErrDNSLookup twice: %v", again)
+	}
+}
+
+func TestLatencyStatsPercentiles(t *testing.T) {
+	s := newLatencyStats()
+	// 1..1000мс по одному разу: q-й квантиль равен q*1000мс
+	for i := 1; i <= 1000; i++ {
+		s.record("/slow", time.Duration(i)*time.Millisecond)
+	}
+	s.record("/fast", 50*time.Microsecond)
+
+	snap := s.snapshot()
+	slow := snap["/slow"]
+	if slow.Count != 1000 {
+		t.Errorf("count = %d, want 1000", slow.Count)
+	}
+	// корзины дают погрешность до 19% сверху и никогда снизу
+	for _, tt := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"p50", slow.P50, 500},
+		{"p90", slow.P90, 900},
+		{"p99", slow.P99, 990},
+	} {
+		if tt.got < tt.want || tt.got > tt.want*1.19 {
+			t.Errorf("%s = %.1fms, want within [%.0f, %.0f]", tt.name, tt.got, tt.want, tt.want*1.19)
+		}
+	}
+	if fast := snap["/fast"]; fast.Count != 1 || fast.P99 != 0.1 {
+		t.Errorf("/fast = %+v, want one sample in the first 0.1ms bucket", fast)
+	}
+}
+
+func TestHistogramOverflow(t *testing.T) {
+	h := &histogram{buckets: make([]int64, len(latencyBounds)+1)}
+	h.record(time.Minute)
+	if got, want := h.percentile(0.5), latencyBounds[len(latencyBounds)-1]; got != want {
+		t.Errorf("percentile of an overflow sample = %v, want the last bound %v", got, want)
+	}
+}
+
+func TestExpectContinueDenialSkipsBody(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) { cfg.MaxUploadBytes = 1000 })
+	srv := httptest.NewServer(http.HandlerFunc(uploadHandler))
+	defer srv.Close()
+
+	transport := &http.Transport{ExpectContinueTimeout: 5 * time.Second}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	for _, tt := range []struct {
+		size     int64
+		wantCode int
+		wantRead int64
+	}{
+		{500, http.StatusOK, 500},
+		{4000, http.StatusExpectationFailed, 0},
+	} {
+		body := &countingReader{r: bytes.NewReader(bytes.Repeat([]byte{'x'}, int(tt.size)))}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, body)
+		req.ContentLength = tt.size
+		req.Header.Set("Expect", "100-continue")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("size %d: %v", tt.size, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("size %d: status %d, want %d", tt.size, resp.StatusCode, tt.wantCode)
+		}
+		if got := body.read.Load(); got != tt.wantRead {
+			t.Errorf("size %d: transport read %d body bytes, want %d", tt.size, got, tt.wantRead)
+		}
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	tests := []struct {
+		links []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{`</page?n=2>; rel="next"`}, "/page?n=2"},
+		{[]string{`</page?n=1>; rel="prev", </page?n=3>; rel="next"`}, "/page?n=3"},
+		{[]string{`</page?n=1>; rel="prev"`, `</page?n=3>; rel="next"`}, "/page?n=3"},
+		{[]string{`<https://api.example.com/items?page=2>; REL=next`}, "https://api.example.com/items?page=2"},
+		{[]string{`</p2>; title="x"; rel="last next"`}, "/p2"},
+		{[]string{`</page?n=1>; rel="prev"`}, ""},
+		{[]string{`/page?n=2; rel="next"`}, ""},
+		{[]string{`</page?n=2>; rel="nextish"`}, ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		for _, link := range tt.links {
+			header.Add("Link", link)
+		}
+		if got := nextLink(header); got != tt.want {
+			t.Errorf("nextLink(%q) = %q, want %q", tt.links, got, tt.want)
+		}
+	}
+}
+
+func TestGetAllPages(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /page", pageHandler)
+	mux.HandleFunc("GET /loop", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</loop>; rel="next"`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var pages []page
+	err := getAllPages(context.Background(), http.DefaultClient, srv.URL+"/page", func(body []byte) {
+		p := page{}
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Errorf("bad page %q: %v", body, err)
+		}
+		pages = append(pages, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []page{
+		{Page: 1, Items: []int{1, 2, 3, 4}},
+		{Page: 2, Items: []int{5, 6, 7, 8}},
+		{Page: 3, Items: []int{9, 10}},
+	}
+	if fmt.Sprint(pages) != fmt.Sprint(want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+
+	err = getAllPages(context.Background(), http.DefaultClient, srv.URL+"/loop", func([]byte) {})
+	if err == nil || !strings.Contains(err.Error(), "pagination loop") {
+		t.Errorf("self-referencing next link: want loop error, got %v", err)
+	}
+}
+
+func TestContextValues(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	ctx := withPrincipal(withRequestID(withStart(context.Background(), start), "req-1"), "rvasily")
+
+	if got, ok := startFrom(ctx); !ok || !got.Equal(start) {
+		t.Errorf("startFrom = %v, %v", got, ok)
+	}
+	if got, ok := requestIDFrom(ctx); !ok || got != "req-1" {
+		t.Errorf("requestIDFrom = %q, %v", got, ok)
+	}
+	if got, ok := principalFrom(ctx); !ok || got != "rvasily" {
+		t.Errorf("principalFrom = %q, %v", got, ok)
+	}
+
+	empty := context.Background()
+	if _, ok := startFrom(empty); ok {
+		t.Error("startFrom found a value in an empty context")
+	}
+	if _, ok := requestIDFrom(empty); ok {
+		t.Error("requestIDFrom found a value in an empty context")
+	}
+	if _, ok := principalFrom(empty); ok {
+		t.Error("principalFrom found a value in an empty context")
+	}
+}
+
+func TestContextKeysDoNotCollide(t *testing.T) {
+	// оба значения - строки, но ключи разных типов
+	ctx := withRequestID(context.Background(), "req-1")
+	if got, ok := principalFrom(ctx); ok {
+		t.Errorf("principalFrom read the request id: %q", got)
+	}
+
+	// чужой ключ с тем же именем типа и строковый ключ ничего не перетирают
+	type requestIDKey struct{}
+	ctx = context.WithValue(ctx, requestIDKey{}, "foreign")
+	ctx = context.WithValue(ctx, "requestIDKey", "string key")
+	if got, _ := requestIDFrom(ctx); got != "req-1" {
+		t.Errorf("requestIDFrom = %q after foreign keys, want req-1", got)
+	}
+
+	ctx = withPrincipal(ctx, "rvasily")
+	if got, _ := requestIDFrom(ctx); got != "req-1" {
+		t.Errorf("requestIDFrom = %q after withPrincipal, want req-1", got)
+	}
+}
+
+func TestThrottledReaderRate(t *testing.T) {
+	const (
+		size = 4 << 10
+		rate = 8 << 10
+	)
+	tr := &throttledReader{
+		ctx:         context.Background(),
+		r:           ioutil.NopCloser(bytes.NewReader(make([]byte, size))),
+		bytesPerSec: rate,
+	}
+
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, tr)
+	elapsed := time.Since(start)
+	if err != nil || n != size {
+		t.Fatalf("copy = %d, %v", n, err)
+	}
+
+	// 4KB на 8KB/s - полсекунды, быстрее нельзя, медленнее - с запасом на планировщик
+	want := time.Duration(size * int64(time.Second) / rate)
+	if elapsed < want*9/10 || elapsed > want*2 {
+		t.Errorf("read %d bytes in %v, want about %v", n, elapsed, want)
+	}
+}
+
+func TestThrottledReaderCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	tr := &throttledReader{
+		ctx:         ctx,
+		r:           ioutil.NopCloser(bytes.NewReader(make([]byte, 64<<10))),
+		bytesPerSec: 1 << 10,
+	}
+
+	start := time.Now()
+	_, err := io.Copy(ioutil.Discard, tr)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancel took %v", elapsed)
+	}
+}
+
+// newDrainTestServer поднимает /shutdown-status рядом с /hold, который
+// держит запрос, пока не закрыт release
+func newDrainTestServer(t *testing.T, release chan struct{}) (*httptest.Server, *drainState, chan struct{}) {
+	t.Helper()
+	conns := newConnLimiter(0, 0)
+	drain := newDrainState()
+	status := shutdownStatusHandler(conns, drain, time.Minute)
+	statusDone := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hold", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	mux.HandleFunc("GET /shutdown-status", func(w http.ResponseWriter, r *http.Request) {
+		defer close(statusDone)
+		status(w, r)
+	})
+
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.ConnState = conns.connState
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts, drain, statusDone
+}
+
+// holdRequest запускает долгий запрос и ждёт, пока сервер начнёт его обрабатывать
+func holdRequest(t *testing.T, serverURL string) {
+	t.Helper()
+	started := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, serverURL+"/hold", nil)
+		trace := &httptrace.ClientTrace{WroteRequest: func(httptrace.WroteRequestInfo) { close(started) }}
+		resp, err := http.DefaultClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	time.Sleep(50 * time.Millisecond)
+}
+
+type sseReader struct {
+	scanner *bufio.Scanner
+}
+
+func (s *sseReader) next(t *testing.T) (string, drainEvent) {
+	t.Helper()
+	event := ""
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			continue
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			ev := drainEvent{}
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatalf("bad event data %q: %v", data, err)
+			}
+			return event, ev
+		}
+	}
+	t.Fatalf("stream ended: %v", s.scanner.Err())
+	return "", drainEvent{}
+}
+
+func TestShutdownStatusActiveDecreases(t *testing.T) {
+	release := make(chan struct{})
+	ts, drain, _ := newDrainTestServer(t, release)
+	holdRequest(t, ts.URL)
+
+	resp, err := http.Get(ts.URL + "/shutdown-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := &sseReader{scanner: bufio.NewScanner(resp.Body)}
+
+	if event, ev := events.next(t); event != "waiting" || ev.Active != 1 {
+		t.Fatalf("first event = %s %+v, want waiting with 1 active", event, ev)
+	}
+
+	drain.begin()
+	if event, ev := events.next(t); event != "drain" || ev.Active != 1 {
+		t.Fatalf("after shutdown = %s %+v, want drain with 1 active", event, ev)
+	}
+
+	close(release)
+	event, ev := events.next(t)
+	if event != "done" || ev.Active != 0 || !ev.Drained {
+		t.Fatalf("after release = %s %+v, want done with 0 active", event, ev)
+	}
+}
+
+func TestShutdownStatusStopsOnClientCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ts, drain, statusDone := newDrainTestServer(t, release)
+	holdRequest(t, ts.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/shutdown-status", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := &sseReader{scanner: bufio.NewScanner(resp.Body)}
+	events.next(t)
+	drain.begin()
+	events.next(t)
+
+	// долгий запрос ещё висит, timeout - минута: выйти можно только по отмене клиента
+	cancel()
+	select {
+	case <-statusDone:
+	case <-time.After(time.Second):
+		t.Fatal("handler kept polling after the client went away")
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id, err := newUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !uuidV4.MatchString(id) {
+			t.Fatalf("malformed uuid %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate uuid %q after %d", id, i)
+		}
+		seen[id] = true
+	}
+}
+
+func TestUUIDV4Pattern(t *testing.T) {
+	bad := []string{
+		"",
+		"0f8fad5b-d9cb-369f-a165-70867728950e", // версия 3
+		"0f8fad5b-d9cb-469f-c165-70867728950e", // вариант c
+		"0F8FAD5B-D9CB-469F-A165-70867728950E", // верхний регистр
+		"0f8fad5bd9cb469fa16570867728950e",     // без дефисов
+		"0f8fad5b-d9cb-469f-a165-70867728950e0",
+	}
+	for _, id := range bad {
+		if uuidV4.MatchString(id) {
+			t.Errorf("uuidV4 accepted %q", id)
+		}
+	}
+}
+
+func TestFetchUUID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(uuidHandler))
+	defer ts.Close()
+
+	a, err := fetchUUID(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fetchUUID(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("two requests returned the same uuid %q", a)
+	}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(uuidResult{UUID: "not-a-uuid"})
+	}))
+	defer broken.Close()
+	if _, err := fetchUUID(broken.URL); err == nil {
+		t.Error("fetchUUID accepted a malformed uuid")
+	}
+}
+
+func TestResetHandler(t *testing.T) {
+	ts := httptest.NewServer(&resetHandler{})
+	defer ts.Close()
+	ctx := context.Background()
+
+	for _, mode := range []string{"eof", "rst"} {
+		client := NewClient(WithBaseURL(ts.URL))
+		body, err := client.GetBytes(ctx, "/reset?mode="+mode)
+		if !errors.Is(err, ErrConnectionReset) {
+			t.Errorf("mode=%s: err = %v, want ErrConnectionReset", mode, err)
+		}
+		if body != nil {
+			t.Errorf("mode=%s: got %d bytes of a partial body", mode, len(body))
+		}
+	}
+
+	// с key обрывается только первый ответ, повтор получает тело целиком
+	client := NewClient(WithBaseURL(ts.URL), WithRetries(1))
+	body, err := client.GetBytes(ctx, "/reset?mode=rst&key=retry")
+	if err != nil {
+		t.Fatalf("retry with key: %v", err)
+	}
+	if len(body) != resetBodySize {
+		t.Errorf("retry with key: got %d bytes, want %d", len(body), resetBodySize)
+	}
+
+	resp, err := http.Get(ts.URL + "/reset?mode=fin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("mode=fin: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestTemplateHandlerEscapes(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/template?name=%3Cscript%3Ealert(1)%3C%2Fscript%3E", nil)
+	templateHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	page := w.Body.String()
+	if strings.Contains(page, "<script>") {
+		t.Fatalf("page contains raw <script>:\n%s", page)
+	}
+	if !strings.Contains(page, "<h1>Hello, &lt;script&gt;alert(1)&lt;/script&gt;!</h1>") {
+		t.Errorf("heading is not html-escaped:\n%s", page)
+	}
+	if !strings.Contains(page, `href="/template?name=%3cscript%3ealert%281%29%3c%2fscript%3e"`) {
+		t.Errorf("link is not url-escaped:\n%s", page)
+	}
+}
+
+func TestFetchTTFB(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", slowHandler)
+	mux.HandleFunc("/download", downloadHandler)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	ctx := context.Background()
+
+	// у /slow время уходит на ожидание заголовков, тело приходит сразу
+	res := fetch(ctx, ts.Client(), ts.URL+"/slow?ms=200")
+	if res.Err != nil || res.Status != http.StatusOK {
+		t.Fatalf("slow: status %d, err %v", res.Status, res.Err)
+	}
+	if res.TTFB < 200*time.Millisecond {
+		t.Errorf("slow: ttfb %v, want at least 200ms", res.TTFB)
+	}
+	if res.Duration < res.TTFB || res.Duration-res.TTFB > 100*time.Millisecond {
+		t.Errorf("slow: ttfb %v, total %v - body should arrive right after headers", res.TTFB, res.Duration)
+	}
+
+	// у медленного скачивания наоборот: первый байт быстро, тело долго
+	throttled := &http.Client{Transport: &throttledTransport{base: ts.Client().Transport, bytesPerSec: 20 << 10}}
+	res = fetch(ctx, throttled, ts.URL+"/download?size=10240")
+	if res.Err != nil || res.Status != http.StatusOK {
+		t.Fatalf("download: status %d, err %v", res.Status, res.Err)
+	}
+	if res.TTFB > 100*time.Millisecond {
+		t.Errorf("download: ttfb %v, want under 100ms", res.TTFB)
+	}
+	if body := res.Duration - res.TTFB; body < 400*time.Millisecond {
+		t.Errorf("download: body took %v, want about 500ms at 20KB/s", body)
+	}
+}
+
+func TestKVRoundTripAndRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.json")
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = "127.0.0.1:0"
+		cfg.KVPath = path
+		cfg.KVFlushDelay = time.Hour
+	})
+	ctx := context.Background()
+
+	type greeting struct {
+		Hello string `json:"hello"`
+	}
+	serverURL, stop := startStoppableServer(t)
+	if err := kvSet(ctx, serverURL, "greeting", greeting{Hello: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvSet(ctx, serverURL, "temp", 1); err != nil {
+		t.Fatal(err)
+	}
+	got := greeting{}
+	if err := kvGet(ctx, serverURL, "greeting", &got); err != nil || got.Hello != "world" {
+		t.Fatalf("get = %+v, %v", got, err)
+	}
+	if err := kvDelete(ctx, serverURL, "temp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvGet(ctx, serverURL, "temp", new(int)); !errors.Is(err, errKeyNotFound) {
+		t.Fatalf("get after delete: err = %v, want errKeyNotFound", err)
+	}
+	// таймер сброса - час: файл пишется только при остановке
+	stop()
+
+	serverURL, _ = startStoppableServer(t)
+	got = greeting{}
+	if err := kvGet(ctx, serverURL, "greeting", &got); err != nil || got.Hello != "world" {
+		t.Fatalf("get after restart = %+v, %v", got, err)
+	}
+	if err := kvGet(ctx, serverURL, "temp", new(int)); !errors.Is(err, errKeyNotFound) {
+		t.Errorf("deleted key came back after restart: %v", err)
+	}
+}
+
+func TestLoadKVStoreCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.json")
+	if err := os.WriteFile(path, []byte(`{"answer": 4`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := loadKVStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.data) != 0 {
+		t.Errorf("store from a corrupt file has %d keys", len(store.data))
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("corrupt file left in place: %v", err)
+	}
+	backups, _ := filepath.Glob(path + ".corrupt-*")
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v, want one", backups)
+	}
+	if raw, _ := os.ReadFile(backups[0]); string(raw) != `{"answer": 4` {
+		t.Errorf("backup = %q", raw)
+	}
+
+	// после восстановления хранилище снова пишет файл
+	store.set("answer", json.RawMessage(`42`))
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadKVStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer, _ := reloaded.get("answer"); string(answer) != "42" {
+		t.Errorf("reloaded answer = %s", answer)
+	}
+}
+
+func TestKVStoreWithoutPath(t *testing.T) {
+	store, err := loadKVStore("", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.set("answer", json.RawMessage(`42`))
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if answer, ok := store.get("answer"); !ok || string(answer) != "42" {
+		t.Errorf("get = %s, %v", answer, ok)
+	}
+	if store.timer != nil {
+		t.Error("in-memory store scheduled a flush")
+	}
+}
+
+func TestAggregatePartialFailure(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /version", versionHandler)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusInternalServerError, "disk is full")
+	})
+	mux.Handle("/count", &countHandler{})
+	mux.HandleFunc("/slow", slowHandler)
+	h := newAggregateHandler(mux, 100*time.Millisecond)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/aggregate?slow=2000", nil))
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	// медленный подзапрос не держит весь ответ дольше своего таймаута
+	if elapsed > time.Second {
+		t.Errorf("aggregate took %v with a 100ms sub-request timeout", elapsed)
+	}
+	res := aggregateResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.OK {
+		t.Error("ok = true with failed sub-requests")
+	}
+
+	for _, name := range []string{"version", "count"} {
+		if sub := res.Results[name]; sub.Status != "ok" || len(sub.Data) == 0 {
+			t.Errorf("%s = %+v, want ok with data", name, sub)
+		}
+	}
+	if sub := res.Results["healthz"]; sub.Status != "error" || sub.HTTPStatus != http.StatusInternalServerError {
+		t.Errorf("healthz = %+v, want error with status 500", sub)
+	}
+	if sub := res.Results["slow"]; sub.Status != "error" || !strings.Contains(sub.Error, ErrRequestTimeout.Error()) {
+		t.Errorf("slow = %+v, want a timeout error", sub)
+	}
+}
+
+func TestAggregateBypassesAdmission(t *testing.T) {
+	withServerConfig(t, func(cfg *serverConfig) {
+		cfg.Addr = "127.0.0.1:0"
+		// один слот занят самим /aggregate - сетевые подзапросы получили бы 503
+		cfg.MaxInFlight = 1
+		cfg.QueueSize = 0
+		cfg.MaxConns = 1
+	})
+	serverURL := startTestServer(t)
+
+	resp, err := http.Get(serverURL + "/aggregate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	res := aggregateResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK {
+		t.Errorf("aggregate failed under MaxInFlight=1: %+v", res.Results)
+	}
+}
+
+func TestWithMaintenance(t *testing.T) {
+	defer maintenance.Store(maintenance.Load())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	})
+	mux.HandleFunc(maintenancePath, maintenanceHandler)
+	h := withMaintenance(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	maintenance.Store(false)
+	if w := do(http.MethodGet, "/ping", ""); w.Code != http.StatusOK {
+		t.Fatalf("/ping before maintenance: status %d", w.Code)
+	}
+
+	if w := do(http.MethodPut, maintenancePath, `{"enabled": true}`); w.Code != http.StatusOK {
+		t.Fatalf("enable maintenance: status %d: %s", w.Code, w.Body)
+	}
+	w := do(http.MethodGet, "/ping", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ping during maintenance: status %d, want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+	if w := do(http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("/healthz during maintenance: status %d, want 200", w.Code)
+	}
+
+	// выключатель сам не попадает под обслуживание
+	if w := do(http.MethodPut, maintenancePath, `{"enabled": false}`); w.Code != http.StatusOK {
+		t.Fatalf("disable maintenance: status %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/ping", ""); w.Code != http.StatusOK {
+		t.Errorf("/ping after maintenance: status %d", w.Code)
+	}
+}
+
+// newSleepStreamServer сообщает в канал, когда обработчик вернулся
+func newSleepStreamServer(t *testing.T) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	returned := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { returned <- struct{}{} }()
+		sleepThenStreamHandler(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, returned
+}
+
+func TestSleepThenStreamHeaderTimeout(t *testing.T) {
+	ts, returned := newSleepStreamServer(t)
+	transport := newPooledTransport()
+	transport.ResponseHeaderTimeout = 100 * time.Millisecond
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	start := time.Now()
+	resp, err := client.Get(ts.URL + "?delay=2000&chunks=3&interval=10")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected a header timeout, got a response")
+	}
+	if !errors.Is(classifyErr(err), ErrRequestTimeout) {
+		t.Errorf("err = %v, want ErrRequestTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("header timeout took %v", elapsed)
+	}
+
+	// обработчик бросает ожидание, не досидев двух секунд
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Error("handler kept sleeping after the client gave up")
+	}
+}
+
+func TestSleepThenStreamCancelMidStream(t *testing.T) {
+	ts, returned := newSleepStreamServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// весь ответ шёл бы секунду: 20 кусков раз в 50мс
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"?delay=50&chunks=20&interval=50", nil)
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	first, err := reader.ReadString('\n')
+	if err != nil || first != "chunk 1\n" {
+		t.Fatalf("first chunk = %q, %v", first, err)
+	}
+	start := time.Now()
+	cancel()
+
+	if _, err := ioutil.ReadAll(reader); !errors.Is(err, context.Canceled) {
+		t.Errorf("read after cancel: err = %v, want context.Canceled", err)
+	}
+	select {
+	case <-returned:
+		if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+			t.Errorf("handler stopped %v after cancel", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Error("handler kept streaming after the client cancelled")
+	}
+}